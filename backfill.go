@@ -0,0 +1,322 @@
+//
+// backfill.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Support for reading rotated (and optionally compressed) files and
+// remembering position in plain files.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// fileStamp is position in file saved in stamp file
+type fileStamp struct {
+	inode  uint64
+	offset int64
+	// time when stamp was saved
+	time time.Time
+}
+
+func fileInode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
+
+// loadFileStamp read position saved in stamp file; returns nil when
+// stamp not exists or is invalid.
+func loadFileStamp(filename string) *fileStamp {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil
+	}
+
+	var s fileStamp
+	var ts int64
+	if _, err := fmt.Sscanf(string(data), "%d %d %d", &s.inode, &s.offset, &ts); err != nil {
+		return nil
+	}
+	s.time = time.Unix(ts, 0)
+
+	return &s
+}
+
+// saveFileStamp write current position in file `path` into stamp file
+func saveFileStamp(filename, path string, offset int64) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return errors.Wrap(err, "stat file error")
+	}
+
+	return writeFileStamp(filename, &fileStamp{fileInode(fi), offset, time.Now()})
+}
+
+// writeFileStamp write stamp `s` into stamp file
+func writeFileStamp(filename string, s *fileStamp) error {
+	data := fmt.Sprintf("%d %d %d", s.inode, s.offset, s.time.Unix())
+	return errors.Wrap(writeFileAtomic(filename, []byte(data)),
+		"write stamp error")
+}
+
+// writeFileAtomic write `data` to temporary file and rename it to
+// `filename`, so file is never left partially written.
+func writeFileAtomic(filename string, data []byte) error {
+	dir, name := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpname := f.Name()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpname, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpname, filename)
+	}
+
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
+
+// rotatedSuffixRe match suffixes of rotated files: number or date
+// (.1, -20170901, -2017-09-01) optionally followed by compression extension
+var rotatedSuffixRe = regexp.MustCompile(
+	`^([.-](\d+|\d{4}-?\d{2}-?\d{2}(-\d+)?))?(\.(gz|bz2|zst))?$`)
+
+// findRotatedFiles return list of rotated files for `path` (path.1,
+// path.2.gz, path-20170901 etc.) sorted from the oldest. Other files (i.e.
+// stamp file, backups) are skipped.
+func findRotatedFiles(path string) ([]string, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "read directory error")
+	}
+
+	var files []os.FileInfo
+	for _, e := range entries {
+		name := e.Name()
+		if name == base || !e.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasPrefix(name, base) && rotatedSuffixRe.MatchString(name[len(base):]) {
+			files = append(files, e)
+		}
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	res := make([]string, 0, len(files))
+	for _, f := range files {
+		res = append(res, filepath.Join(dir, f.Name()))
+	}
+
+	return res, nil
+}
+
+type decompressReader struct {
+	io.Reader
+	closers []func() error
+}
+
+func (d *decompressReader) Close() (err error) {
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if e := d.closers[i](); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+// openDecompressed open file and decompress it according to magic bytes
+func openDecompressed(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file error")
+	}
+
+	br := bufio.NewReader(f)
+	dr := &decompressReader{Reader: br, closers: []func() error{f.Close}}
+
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "open gzip error")
+		}
+		dr.Reader = gr
+		dr.closers = append(dr.closers, gr.Close)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		dr.Reader = bzip2.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "open zstd error")
+		}
+		dr.Reader = zr
+		dr.closers = append(dr.closers, func() error {
+			zr.Close()
+			return nil
+		})
+	}
+
+	return dr, nil
+}
+
+// backfillFile is one file to read on start
+type backfillFile struct {
+	path   string
+	offset int64
+	// inode and modification time of file when backfill was prepared; used
+	// for saving position
+	inode   uint64
+	modTime time.Time
+}
+
+// backfillLine is line read from rotated file
+type backfillLine struct {
+	text string
+	// pos is position in file after line (offset in decompressed data)
+	pos fileStamp
+}
+
+// prepareBackfill find rotated files to read before live file `path`.
+// When stamp is given, files already processed are skipped and reading is
+// started from saved offset. Stamp may point to live file from last run or
+// to rotated file when previous backfill was not finished; all files newer
+// than this file are read. Returns offset in live file to start reading.
+func prepareBackfill(path string, stamp *fileStamp) (files []backfillFile, liveOffset int64, err error) {
+	rotated, err := findRotatedFiles(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if stamp != nil {
+		if fi, err := os.Stat(path); err == nil && fileInode(fi) == stamp.inode {
+			// nothing rotated since last run
+			return nil, stamp.offset, nil
+		}
+	}
+
+	found := false
+	for _, r := range rotated {
+		fi, err := os.Stat(r)
+		if err != nil {
+			continue
+		}
+
+		offset := int64(0)
+		if stamp != nil && !found {
+			if fileInode(fi) == stamp.inode {
+				// file was live file or backfilled file on last run
+				offset = stamp.offset
+				files = files[:0]
+				found = true
+			} else if fi.ModTime().Before(stamp.time) {
+				// file processed in previous run
+				continue
+			}
+		}
+
+		files = append(files, backfillFile{r, offset, fileInode(fi), fi.ModTime()})
+	}
+
+	return files, 0, nil
+}
+
+// readBackfill read lines from `files` and send it to `lines`; stop when
+// `quit` is closed.
+func readBackfill(files []backfillFile, lines chan<- backfillLine, quit <-chan struct{}, l logger) {
+	defer close(lines)
+
+	for _, bf := range files {
+		l.Infof("backfill from %s (offset %d)", bf.path, bf.offset)
+
+		r, err := openDecompressed(bf.path)
+		if err != nil {
+			l.Errorf("backfill %s error: %s", bf.path, err)
+			continue
+		}
+
+		if bf.offset > 0 {
+			if _, err := io.CopyN(ioutil.Discard, r, bf.offset); err != nil {
+				l.Errorf("backfill %s seek error: %s", bf.path, err)
+				r.Close()
+				continue
+			}
+		}
+
+		// position after last line
+		pos := fileStamp{bf.inode, bf.offset, bf.modTime}
+
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+			advance, token, err := bufio.ScanLines(data, atEOF)
+			pos.offset += int64(advance)
+			return advance, token, err
+		})
+		for scanner.Scan() {
+			select {
+			case lines <- backfillLine{scanner.Text(), pos}:
+			case <-quit:
+				r.Close()
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			l.Errorf("backfill %s read error: %s", bf.path, err)
+		}
+
+		r.Close()
+	}
+}
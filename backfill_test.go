@@ -0,0 +1,280 @@
+//
+// backfill_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writeTestFile(t *testing.T, path, content string, compress bool, mtime time.Time) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("create file error: %s", err)
+	}
+
+	if compress {
+		gw := gzip.NewWriter(f)
+		gw.Write([]byte(content))
+		gw.Close()
+	} else {
+		f.WriteString(content)
+	}
+	f.Close()
+
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("set mtime error: %s", err)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	live := filepath.Join(dir, "app.log")
+	now := time.Now()
+	writeTestFile(t, live+".2.gz", "line1\nline2\n", true, now.Add(-2*time.Hour))
+	writeTestFile(t, live+".1", "line3\nline4\n", false, now.Add(-time.Hour))
+	writeTestFile(t, live, "line5\n", false, now)
+	writeTestFile(t, filepath.Join(dir, "other.log.1"), "other\n", false, now)
+
+	files, offset, err := prepareBackfill(live, nil)
+	if err != nil {
+		t.Fatalf("prepare backfill error: %s", err)
+	}
+	if len(files) != 2 || offset != 0 || files[0].path != live+".2.gz" || files[1].path != live+".1" {
+		t.Fatalf("invalid files to backfill: %+v, %d", files, offset)
+	}
+
+	gzInode := files[0].inode
+
+	lines := make(chan backfillLine)
+	go readBackfill(files, lines, make(chan struct{}), log)
+
+	var res []backfillLine
+	for l := range lines {
+		res = append(res, l)
+	}
+	if len(res) != 4 || res[0].text != "line1" || res[3].text != "line4" {
+		t.Fatalf("invalid lines read: %v", res)
+	}
+	// position in decompressed file
+	if res[1].pos.offset != 12 || res[1].pos.inode != gzInode || res[2].pos.offset != 6 {
+		t.Errorf("invalid lines positions: %v", res)
+	}
+
+	// live file from previous run was rotated to app.log.1
+	stamp := filepath.Join(dir, "stamp")
+	if err := saveFileStamp(stamp, live+".1", 6); err != nil {
+		t.Fatalf("save stamp error: %s", err)
+	}
+	fs := loadFileStamp(stamp)
+	if fs == nil || fs.offset != 6 {
+		t.Fatalf("invalid stamp loaded: %+v", fs)
+	}
+
+	files, offset, err = prepareBackfill(live, fs)
+	if err != nil {
+		t.Fatalf("prepare backfill error: %s", err)
+	}
+	if len(files) != 1 || files[0].path != live+".1" || files[0].offset != 6 || offset != 0 {
+		t.Errorf("invalid files to backfill with stamp: %+v, %d", files, offset)
+	}
+
+	// backfill interrupted in app.log.2.gz; newer files are read even when
+	// modified before stamp
+	fs = &fileStamp{gzInode, 6, now}
+	if files, _, err = prepareBackfill(live, fs); err != nil {
+		t.Fatalf("prepare backfill error: %s", err)
+	}
+	if len(files) != 2 || files[0].path != live+".2.gz" || files[0].offset != 6 || files[1].offset != 0 {
+		t.Errorf("invalid files to backfill with backfill stamp: %+v", files)
+	}
+
+	// live file not rotated
+	if err := saveFileStamp(stamp, live, 3); err != nil {
+		t.Fatalf("save stamp error: %s", err)
+	}
+	files, offset, err = prepareBackfill(live, loadFileStamp(stamp))
+	if err != nil || len(files) != 0 || offset != 3 {
+		t.Errorf("invalid backfill for not rotated file: %+v, %d, %v", files, offset, err)
+	}
+}
+
+func TestFindRotatedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	live := filepath.Join(dir, "app.log")
+	now := time.Now()
+	rotated := []string{".3.gz", "-20170901", "-2017-09-02.gz", ".1"}
+	for i, suffix := range rotated {
+		writeTestFile(t, live+suffix, "", false, now.Add(time.Duration(i-10)*time.Minute))
+	}
+	for _, suffix := range []string{"", ".stamp", ".bak", "-old.swp", ".1.tmp", "x.1"} {
+		writeTestFile(t, live+suffix, "", false, now)
+	}
+
+	files, err := findRotatedFiles(live)
+	if err != nil {
+		t.Fatalf("find rotated files error: %s", err)
+	}
+	if len(files) != len(rotated) {
+		t.Fatalf("invalid rotated files: %v", files)
+	}
+	for i, suffix := range rotated {
+		if files[i] != live+suffix {
+			t.Errorf("invalid file %d: %s, expected %s", i, files[i], live+suffix)
+		}
+	}
+}
+
+func TestPlainFileStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	live := filepath.Join(dir, "app.log")
+	stamp := filepath.Join(dir, "app.stamp")
+	writeTestFile(t, live, "line1\nline2\nline3\nline4\n", false, time.Now())
+	if err := saveFileStamp(stamp, live, 0); err != nil {
+		t.Fatalf("save stamp error: %s", err)
+	}
+
+	conf := &WorkerConf{File: live, StampFile: stamp}
+	r, _ := (&PlainFileReader{}).Create(conf, log)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("start error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if _, err := r.Read(ctx); err != nil {
+			t.Fatalf("read error: %s", err)
+		}
+	}
+	// let tail read ahead
+	time.Sleep(100 * time.Millisecond)
+	r.Stop()
+
+	// position after consumed lines
+	if fs := loadFileStamp(stamp); fs == nil || fs.offset != 12 {
+		t.Errorf("invalid stamp: %+v", fs)
+	}
+
+	// stamp is not written in once mode
+	defer func(v bool) { *runOnce = v }(*runOnce)
+	*runOnce = true
+	r, _ = (&PlainFileReader{}).Create(conf, log)
+	r.Start(context.Background())
+	read := 0
+	for {
+		if _, err := r.Read(ctx); err != nil {
+			break
+		}
+		read++
+	}
+	r.Stop()
+	if fs := loadFileStamp(stamp); fs == nil || fs.offset != 12 {
+		t.Errorf("stamp modified in once mode: %+v", fs)
+	}
+	// stamp is not used in once mode
+	if read != 4 {
+		t.Errorf("invalid number of lines read in once mode: %d", read)
+	}
+}
+
+func TestPlainFileBackfillStamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	live := filepath.Join(dir, "app.log")
+	stamp := filepath.Join(dir, "app.stamp")
+	now := time.Now()
+	writeTestFile(t, live+".2.gz", "line1\nline2\n", true, now.Add(-2*time.Hour))
+	writeTestFile(t, live+".1", "line3\nline4\n", false, now.Add(-time.Hour))
+	writeTestFile(t, live, "line5\n", false, now)
+
+	conf := &WorkerConf{File: live, StampFile: stamp, Options: map[string]string{"backfill": "yes"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// stop in the middle of backfill
+	r, _ := (&PlainFileReader{}).Create(conf, log)
+	if err := r.Start(ctx); err != nil {
+		t.Fatalf("start error: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := r.Read(ctx); err != nil {
+			t.Fatalf("read error: %s", err)
+		}
+	}
+	r.Stop()
+
+	r, _ = (&PlainFileReader{}).Create(conf, log)
+	if err := r.Start(ctx); err != nil {
+		t.Fatalf("start error: %s", err)
+	}
+	defer r.Stop()
+	for _, exp := range []string{"line4", "line5"} {
+		rec, err := r.Read(ctx)
+		if err != nil || rec.Message != exp {
+			t.Fatalf("invalid record after restart: %+v, %v; expected %s", rec, err, exp)
+		}
+	}
+}
+
+func TestPlainFileLag(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	live := filepath.Join(dir, "app.log")
+	writeTestFile(t, live, "line1\n", false, time.Now())
+
+	conf := &WorkerConf{File: live}
+	r, _ := (&PlainFileReader{}).Create(conf, log)
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatalf("start error: %s", err)
+	}
+	defer r.Stop()
+
+	f, err := os.OpenFile(live, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("open file error: %s", err)
+	}
+	f.WriteString("line2\nline3\n")
+	f.Close()
+
+	// lag is updated by ticker also when no line is read
+	time.Sleep(plainFileCheckInterval + 500*time.Millisecond)
+	if v := testutil.ToFloat64(fileLag.WithLabelValues(live)); v != 12 {
+		t.Errorf("invalid lag: %v", v)
+	}
+}
@@ -5,12 +5,15 @@
 package main
 
 import (
+	"fmt"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"os"
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 )
 
 type (
@@ -20,6 +23,8 @@ type (
 		Include []string
 		// Exclude is list patterns that line must not contain to accept
 		Exclude []string
+		// Field is name of record field to check instead of message
+		Field string
 
 		XUnknown map[string]interface{} `yaml:",inline"`
 	}
@@ -35,8 +40,36 @@ type (
 
 		Labels map[string]string
 
+		// FieldLabels define labels which values are taken from record fields
+		// (label name -> field name)
+		FieldLabels map[string]string `yaml:"field_labels"`
+
 		// ValuePattern define re pattern extracted from line and exposed as metrics.
 		ValuePattern string `yaml:"value_pattern"`
+		// ValueField is name of record field used to extract value instead of message
+		ValueField string `yaml:"value_field"`
+
+		// SampleRate is fraction of records evaluated by metric; counters
+		// are scaled. 0 or 1 - evaluate all records
+		SampleRate float64 `yaml:"sample_rate"`
+		// MaxPerSecond limit number of records evaluated by metric per
+		// second; 0 - no limit
+		MaxPerSecond int `yaml:"max_per_second"`
+		// LimitMatched apply sample_rate and max_per_second only to records
+		// matched by metric (patterns are evaluated for all records)
+		LimitMatched bool `yaml:"limit_matched"`
+
+		// Notify configure sending matched records to webhook
+		Notify *NotifyConf `yaml:"notify"`
+		// Forward configure writing matched lines to file or socket
+		Forward *ForwardConf `yaml:"forward"`
+		// Samples is number of last accepted lines kept in memory
+		Samples int
+
+		// Template is name of metric template used as base for metric
+		Template string `yaml:"template"`
+		// PatternSets are names of pattern sets appended to patterns
+		PatternSets []string `yaml:"pattern_sets"`
 
 		StaticLabels []string `yaml:"-"`
 	}
@@ -53,14 +86,144 @@ type (
 		StampFile string `yaml:"stamp_file"`
 		// options for worker
 		Options map[string]string `yaml:"options"`
+		// Pipeline configure parallel processing of records
+		Pipeline *PipelineConf `yaml:"pipeline"`
+		// Forward configure writing lines accepted by any metric to file
+		// or socket
+		Forward *ForwardConf `yaml:"forward"`
+
+		XUnknown map[string]interface{} `yaml:",inline"`
+
+		// source is name of file that define worker
+		source string
+	}
+
+	// NotifyConf configure sending matched records to webhook
+	NotifyConf struct {
+		// URL of webhook
+		URL string `yaml:"url"`
+		// BatchSize is max number of records in one request; default 10
+		BatchSize int `yaml:"batch_size"`
+		// Interval is max time of waiting for full batch; default 5s
+		Interval time.Duration
+		// Retries is number of retries on error; default 3, 0 - no retries
+		Retries *int
+		// Timeout of request; default 10s
+		Timeout time.Duration
+		// RateLimit is max number of records sent in RateWindow; 0 - no limit
+		RateLimit int `yaml:"rate_limit"`
+		// RateWindow for rate limit; default 1m
+		RateWindow time.Duration `yaml:"rate_window"`
+
+		XUnknown map[string]interface{} `yaml:",inline"`
+	}
+
+	// ForwardConf configure forwarding accepted lines
+	ForwardConf struct {
+		// Target is file name, unix:<path> or tcp:<host:port>
+		Target string
+		// Labels enable prefixing lines by metric name and labels
+		Labels bool
+		// MaxSize is size of file that cause rotation; default 10MB
+		MaxSize int64 `yaml:"max_size"`
+		// MaxFiles is number of rotated files to keep; default 3
+		MaxFiles int `yaml:"max_files"`
+
+		XUnknown map[string]interface{} `yaml:",inline"`
+	}
+
+	// PipelineConf configure pool of goroutines that match records read
+	// by worker
+	PipelineConf struct {
+		// Workers is number of goroutines matching records; <= 1 - match
+		// records in reading goroutine. With more workers counters are exact
+		// but gauges (*_value, *_last_match_seconds) may be set from records
+		// in other order than in file.
+		Workers int
+		// QueueSize is size of queue between reader and matching goroutines
+		QueueSize int `yaml:"queue_size"`
+		// DropWhenFull cause dropping records when queue is full instead of
+		// waiting
+		DropWhenFull bool `yaml:"drop_when_full"`
+
+		XUnknown map[string]interface{} `yaml:",inline"`
+	}
+
+	// PushConf configure pushing metrics to Prometheus Pushgateway
+	PushConf struct {
+		// URL of Pushgateway
+		URL string `yaml:"url"`
+		// Job name; default "logmonitor"
+		Job string
+		// Interval between pushes; default 1m
+		Interval time.Duration
+		// Grouping labels added to Pushgateway url
+		Grouping map[string]string
+
+		XUnknown map[string]interface{} `yaml:",inline"`
+	}
+
+	// RemoteWriteConf configure sending metrics by Prometheus remote_write
+	// protocol
+	RemoteWriteConf struct {
+		// URL of remote write endpoint
+		URL string `yaml:"url"`
+		// Interval between sending metrics; default 30s
+		Interval time.Duration
+		// Timeout for one request; default 10s
+		Timeout time.Duration
+		// BufferSize is max number of requests kept for retry; default 10
+		BufferSize int `yaml:"buffer_size"`
+		// ExternalLabels are added to all series (when series don't have
+		// label with the same name); default: instance=<hostname>. Empty
+		// map disable default.
+		ExternalLabels map[string]string `yaml:"external_labels"`
+
+		XUnknown map[string]interface{} `yaml:",inline"`
+	}
+
+	// TextfileConf configure writing metrics to file for node_exporter
+	// textfile collector
+	TextfileConf struct {
+		// Path of file; should have .prom extension
+		Path string
+		// Interval between writes; default 15s
+		Interval time.Duration
+
+		XUnknown map[string]interface{} `yaml:",inline"`
+	}
+
+	// OutputConf configure additional output (sink) for observed events
+	OutputConf struct {
+		// Type of output (i.e. statsd)
+		Type string
+		// Disabled allow disable some outputs
+		Disabled bool
+		// Options for output
+		Options map[string]string `yaml:"options"`
 
 		XUnknown map[string]interface{} `yaml:",inline"`
 	}
 
 	// Configuration keep application configuration
 	Configuration struct {
+		// Include is list of glob patterns of additional configuration files
+		// (relative to main configuration file)
+		Include []string `yaml:"include"`
+		// PatternSets are named lists of patterns used by metrics
+		PatternSets map[string][]*Filter `yaml:"pattern_sets"`
+		// MetricTemplates are named metrics definitions used by metrics
+		MetricTemplates map[string]*Metric `yaml:"metric_templates"`
 		// Workers is list of workers
 		Workers []*WorkerConf
+		// Push configure optional pushing metrics to Pushgateway
+		Push *PushConf `yaml:"push"`
+		// RemoteWrite configure optional sending metrics by remote_write
+		RemoteWrite *RemoteWriteConf `yaml:"remote_write"`
+		// Textfile configure optional writing metrics to file
+		Textfile *TextfileConf `yaml:"textfile"`
+		// Outputs is list of additional outputs for observed events
+		Outputs []*OutputConf `yaml:"outputs"`
 
 		XUnknown map[string]interface{} `yaml:",inline"`
 	}
@@ -92,12 +255,13 @@ func (c *Configuration) validate() error {
 			continue
 		}
 		if f.File == "" {
-			return errors.Errorf("missing 'file' in %+v", f)
+			return errors.Errorf("missing 'file' in %s", f.location(i))
 		}
-		if ruleNum, exists := usedFiles[f.File]; exists {
-			return errors.Errorf("file '%s' already defined in rule %d", f.File, ruleNum)
+		if prev, exists := usedFiles[f.File]; exists {
+			return errors.Errorf("file '%s' in %s already defined in %s", f.File,
+				f.location(i), c.Workers[prev].location(prev))
 		}
-		usedFiles[f.File] = i + 1
+		usedFiles[f.File] = i
 	}
 
 	// check for unknown fields
@@ -105,6 +269,45 @@ func (c *Configuration) validate() error {
 		log.Warnf("unknown fields in configuraton: %s", msg)
 	}
 
+	if err := c.Push.validate(); err != nil {
+		return errors.Wrap(err, "invalid push configuration")
+	}
+	if c.Push != nil {
+		if msg := checkUnknown(c.Push.XUnknown); msg != "" {
+			log.Warnf("unknown fields in push configuration: %s", msg)
+		}
+	}
+
+	if err := c.RemoteWrite.validate(); err != nil {
+		return errors.Wrap(err, "invalid remote_write configuration")
+	}
+	if c.RemoteWrite != nil {
+		if msg := checkUnknown(c.RemoteWrite.XUnknown); msg != "" {
+			log.Warnf("unknown fields in remote_write configuration: %s", msg)
+		}
+	}
+
+	if err := c.Textfile.validate(); err != nil {
+		return errors.Wrap(err, "invalid textfile configuration")
+	}
+	if c.Textfile != nil {
+		if msg := checkUnknown(c.Textfile.XUnknown); msg != "" {
+			log.Warnf("unknown fields in textfile configuration: %s", msg)
+		}
+	}
+
+	for i, o := range c.Outputs {
+		if o.Disabled {
+			continue
+		}
+		if err := o.validate(); err != nil {
+			return errors.Wrapf(err, "invalid output %d", i+1)
+		}
+		if msg := checkUnknown(o.XUnknown); msg != "" {
+			log.Warnf("unknown fields in output %d: %s", i+1, msg)
+		}
+	}
+
 	definedLabels := make(map[string][]string)
 
 	for i, f := range c.Workers {
@@ -112,8 +315,23 @@ func (c *Configuration) validate() error {
 			continue
 		}
 
+		loc := f.location(i)
+
 		if msg := checkUnknown(f.XUnknown); msg != "" {
-			log.Warnf("unknown fields in worker %d [%s]: %s", i+1, f.Metrics, msg)
+			log.Warnf("unknown fields in %s: %s", loc, msg)
+		}
+
+		if err := f.Pipeline.validate(); err != nil {
+			return errors.Wrapf(err, "invalid pipeline in %s", loc)
+		}
+		if f.Pipeline != nil {
+			if msg := checkUnknown(f.Pipeline.XUnknown); msg != "" {
+				log.Warnf("unknown fields in %s pipeline: %s", loc, msg)
+			}
+		}
+
+		if err := f.Forward.validate(); err != nil {
+			return errors.Wrapf(err, "invalid forward in %s", loc)
 		}
 
 		for i, m := range f.Metrics {
@@ -122,10 +340,51 @@ func (c *Configuration) validate() error {
 			}
 
 			if err := m.validate(f, i); err != nil {
-				return err
+				return errors.Wrapf(err, "invalid metric in %s", loc)
 			}
 
 			if err := m.validateLabels(f, i, definedLabels); err != nil {
+				return errors.Wrapf(err, "invalid metric in %s", loc)
+			}
+		}
+	}
+
+	return c.validateForwards()
+}
+
+// validateForwards check if forwards to the same target have the same
+// rotation settings (target is written by one shared forwarder)
+func (c *Configuration) validateForwards() error {
+	targets := make(map[string]*ForwardConf)
+	check := func(f *ForwardConf, loc string) error {
+		if f == nil {
+			return nil
+		}
+		prev, ok := targets[f.Target]
+		if !ok {
+			targets[f.Target] = f
+			return nil
+		}
+		if prev.MaxSize != f.MaxSize || prev.MaxFiles != f.MaxFiles {
+			return errors.Errorf("forward to '%s' in %s has other max_size or max_files than previous forward to this target",
+				f.Target, loc)
+		}
+		return nil
+	}
+
+	for i, w := range c.Workers {
+		if w.Disabled {
+			continue
+		}
+		loc := w.location(i)
+		if err := check(w.Forward, loc); err != nil {
+			return err
+		}
+		for _, m := range w.Metrics {
+			if m.Disabled {
+				continue
+			}
+			if err := check(m.Forward, loc+" metric "+m.Name); err != nil {
 				return err
 			}
 		}
@@ -134,6 +393,31 @@ func (c *Configuration) validate() error {
 	return nil
 }
 
+// addReaderLabels add to metrics labels provided by readers
+func (c *Configuration) addReaderLabels() {
+	for _, f := range c.Workers {
+		if f.Disabled || f.File == "" {
+			continue
+		}
+
+		rd, ok := getReaderForConf(f).(ReaderLabelsDef)
+		if !ok {
+			continue
+		}
+
+		for k, v := range rd.Labels(f) {
+			for _, m := range f.Metrics {
+				if m.Labels == nil {
+					m.Labels = make(map[string]string)
+				}
+				if _, exists := m.Labels[k]; !exists {
+					m.Labels[k] = v
+				}
+			}
+		}
+	}
+}
+
 // prepareLabels make list of static labels
 func (c *Configuration) prepareLabels() {
 	for _, f := range c.Workers {
@@ -142,21 +426,83 @@ func (c *Configuration) prepareLabels() {
 		}
 
 		for _, m := range f.Metrics {
-			var labels []string
-			for k := range m.Labels {
-				labels = append(labels, k)
-			}
-			sort.Strings(labels)
+			// values for field labels are set when record is processed
 			m.StaticLabels = []string{f.File}
-			for _, k := range labels {
+			for _, k := range m.labelNames() {
 				m.StaticLabels = append(m.StaticLabels, m.Labels[k])
 			}
 		}
 	}
 }
 
-// LoadConfiguration from `filename`
-func LoadConfiguration(filename string) (*Configuration, error) {
+// LoadOptions configure loading configuration
+type LoadOptions struct {
+	// Dir is optional directory with additional configuration files
+	Dir string
+	// Strict cause unknown fields are errors
+	Strict bool
+
+	// keepVars disable expanding variables (for dumping configuration)
+	keepVars bool
+}
+
+// LoadConfiguration from `filename` and included files
+func LoadConfiguration(filename string, opts LoadOptions) (*Configuration, error) {
+	c, err := loadConfigurationFile(filename, opts.Strict)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := includedFiles(filename, c.Include, opts.Dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "find included files error")
+	}
+
+	for _, f := range files {
+		ic, err := loadConfigurationFile(f, opts.Strict)
+		if err != nil {
+			return nil, errors.Wrapf(err, "load %s error", f)
+		}
+		if err = c.merge(ic, f); err != nil {
+			return nil, errors.Wrapf(err, "merge %s error", f)
+		}
+	}
+
+	if err = c.expand(); err != nil {
+		return nil, errors.Wrap(err, "configuration expand error")
+	}
+
+	if !opts.keepVars {
+		if err = c.expandEnv(); err != nil {
+			return nil, errors.Wrap(err, "configuration variables expand error")
+		}
+	}
+
+	c.addReaderLabels()
+
+	if err = c.validate(); err != nil {
+		return nil, errors.Wrap(err, "configuration validate error")
+	}
+
+	c.prepareLabels()
+
+	return c, nil
+}
+
+// DumpConfiguration load configuration like LoadConfiguration and return it
+// as yaml. Variables are not expanded (values may be secrets).
+func DumpConfiguration(filename string, opts LoadOptions) ([]byte, error) {
+	opts.keepVars = true
+	c, err := LoadConfiguration(filename, opts)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(c)
+}
+
+// loadConfigurationFile load one file; with `strict` unknown fields are
+// errors
+func loadConfigurationFile(filename string, strict bool) (*Configuration, error) {
 	c := &Configuration{}
 	b, err := ioutil.ReadFile(filename)
 
@@ -164,19 +510,31 @@ func LoadConfiguration(filename string) (*Configuration, error) {
 		return nil, errors.Wrap(err, "read configuration file error")
 	}
 
+	if strict {
+		if err = checkStrict(filename, b); err != nil {
+			return nil, errors.Wrap(err, "configuration strict check error")
+		}
+	}
+
 	if err = yaml.Unmarshal(b, c); err != nil {
 		return nil, errors.Wrap(err, "configuration unmarshall error")
 	}
 
-	if err = c.validate(); err != nil {
-		return nil, errors.Wrap(err, "configuration validate error")
+	for _, w := range c.Workers {
+		w.source = filename
 	}
 
-	c.prepareLabels()
-
 	return c, nil
 }
 
+// location return worker number and file that define it
+func (w *WorkerConf) location(i int) string {
+	if w.source == "" {
+		return fmt.Sprintf("worker %d", i+1)
+	}
+	return fmt.Sprintf("worker %d (%s)", i+1, w.source)
+}
+
 func (m *Metric) validate(f *WorkerConf, i int) error {
 	if m.Name == "" {
 		return errors.Errorf("missing metric name in %+v", m)
@@ -186,26 +544,73 @@ func (m *Metric) validate(f *WorkerConf, i int) error {
 		return errors.Errorf("invalid metric name: '%s'", m.Name)
 	}
 
+	if m.SampleRate < 0 || m.SampleRate > 1 {
+		return errors.Errorf("invalid sample_rate in '%s': %v", m.Name, m.SampleRate)
+	}
+
+	if m.MaxPerSecond < 0 {
+		return errors.Errorf("invalid max_per_second in '%s': %v", m.Name, m.MaxPerSecond)
+	}
+
+	if err := m.Notify.validate(); err != nil {
+		return errors.Wrapf(err, "invalid notify in '%s'", m.Name)
+	}
+	if m.Notify != nil {
+		if msg := checkUnknown(m.Notify.XUnknown); msg != "" {
+			log.Warnf("unknown fields in '%s' notify: %s", m.Name, msg)
+		}
+	}
+
+	if m.Samples < 0 {
+		return errors.Errorf("invalid samples in '%s': %v", m.Name, m.Samples)
+	}
+
+	if err := m.Forward.validate(); err != nil {
+		return errors.Wrapf(err, "invalid forward in '%s'", m.Name)
+	}
+
 	for j, p := range m.Patterns {
 		if msg := checkUnknown(p.XUnknown); msg != "" {
-			log.Warnf("unknown fields in worker %d [%s] patterns %d: %s", i+1, f.Metrics, j+1, msg)
+			log.Warnf("unknown fields in %s metric '%s' patterns %d: %s", f.location(i), m.Name, j+1, msg)
 		}
 	}
 
 	return nil
 }
 
+// labelNames return sorted names of static and field labels (without "file")
+func (m *Metric) labelNames() []string {
+	labels := make([]string, 0, len(m.Labels)+len(m.FieldLabels))
+	for k := range m.Labels {
+		labels = append(labels, k)
+	}
+	for k := range m.FieldLabels {
+		if _, ok := m.Labels[k]; !ok {
+			labels = append(labels, k)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
 func (m *Metric) validateLabels(f *WorkerConf, i int, definedLabels map[string][]string) error {
-	var mlabels []string
-	for label := range m.Labels {
+	for label := range m.FieldLabels {
+		if _, ok := m.Labels[label]; ok {
+			return errors.Errorf("label '%s' in '%s' defined as static and field label",
+				label, m.Name)
+		}
+	}
+
+	mlabels := m.labelNames()
+	for _, label := range mlabels {
 		if !isValidName(label) {
 			return errors.Errorf("invalid label name '%s' in '%s'", label, m.Name)
 		}
-		mlabels = append(mlabels, label)
+		if label == "file" {
+			return errors.Errorf("label 'file' is reserved in '%s'", m.Name)
+		}
 	}
 
-	sort.Strings(mlabels)
-
 	dlabels, ok := definedLabels[m.Name]
 	if !ok {
 		definedLabels[m.Name] = mlabels
@@ -226,3 +631,236 @@ func (m *Metric) validateLabels(f *WorkerConf, i int, definedLabels map[string][
 
 	return nil
 }
+
+const (
+	defaultPushJob      = "logmonitor"
+	defaultPushInterval = time.Minute
+)
+
+func (p *PushConf) validate() error {
+	if p == nil {
+		return nil
+	}
+
+	if p.URL == "" {
+		return errors.New("missing url")
+	}
+
+	if p.Job == "" {
+		p.Job = defaultPushJob
+	}
+
+	if p.Interval < 0 {
+		return errors.Errorf("invalid interval: %s", p.Interval)
+	}
+
+	if p.Interval == 0 {
+		p.Interval = defaultPushInterval
+	}
+
+	for k := range p.Grouping {
+		if !isValidName(k) {
+			return errors.Errorf("invalid grouping label name: '%s'", k)
+		}
+	}
+
+	return nil
+}
+
+const (
+	defaultRemoteWriteInterval   = 30 * time.Second
+	defaultRemoteWriteTimeout    = 10 * time.Second
+	defaultRemoteWriteBufferSize = 10
+)
+
+func (r *RemoteWriteConf) validate() error {
+	if r == nil {
+		return nil
+	}
+
+	if r.URL == "" {
+		return errors.New("missing url")
+	}
+
+	if r.Interval < 0 || r.Timeout < 0 || r.BufferSize < 0 {
+		return errors.Errorf("invalid interval, timeout or buffer_size")
+	}
+
+	if r.Interval == 0 {
+		r.Interval = defaultRemoteWriteInterval
+	}
+
+	if r.Timeout == 0 {
+		r.Timeout = defaultRemoteWriteTimeout
+	}
+
+	if r.BufferSize == 0 {
+		r.BufferSize = defaultRemoteWriteBufferSize
+	}
+
+	if r.ExternalLabels == nil {
+		// series from many hosts must be distinguishable
+		if hostname, err := os.Hostname(); err == nil {
+			r.ExternalLabels = map[string]string{"instance": hostname}
+		} else {
+			log.Warnf("get hostname for remote_write instance label error: %s", err)
+		}
+	}
+
+	for name := range r.ExternalLabels {
+		if !isValidName(name) {
+			return errors.Errorf("invalid external label name: '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+const defaultTextfileInterval = 15 * time.Second
+
+func (t *TextfileConf) validate() error {
+	if t == nil {
+		return nil
+	}
+
+	if t.Path == "" {
+		return errors.New("missing path")
+	}
+
+	if !strings.HasSuffix(t.Path, ".prom") {
+		log.Warnf("textfile '%s' has no .prom extension", t.Path)
+	}
+
+	if t.Interval < 0 {
+		return errors.Errorf("invalid interval: %s", t.Interval)
+	}
+
+	if t.Interval == 0 {
+		t.Interval = defaultTextfileInterval
+	}
+
+	return nil
+}
+
+func (o *OutputConf) validate() error {
+	if o.Type == "" {
+		return errors.New("missing type")
+	}
+
+	if _, ok := getSinkDef(o.Type); !ok {
+		return errors.Errorf("unknown type '%s'; available: %s", o.Type,
+			strings.Join(registeredSinkTypes(), ", "))
+	}
+
+	return nil
+}
+
+const (
+	defaultNotifyBatchSize  = 10
+	defaultNotifyInterval   = 5 * time.Second
+	defaultNotifyRetries    = 3
+	defaultNotifyTimeout    = 10 * time.Second
+	defaultNotifyRateWindow = time.Minute
+)
+
+func (n *NotifyConf) validate() error {
+	if n == nil {
+		return nil
+	}
+
+	if n.URL == "" {
+		return errors.New("missing url")
+	}
+
+	if n.BatchSize < 0 || n.Interval < 0 || n.Timeout < 0 ||
+		n.RateLimit < 0 || n.RateWindow < 0 || (n.Retries != nil && *n.Retries < 0) {
+		return errors.New("negative values are not allowed")
+	}
+
+	if n.BatchSize == 0 {
+		n.BatchSize = defaultNotifyBatchSize
+	}
+	if n.Interval == 0 {
+		n.Interval = defaultNotifyInterval
+	}
+	if n.Retries == nil {
+		retries := defaultNotifyRetries
+		n.Retries = &retries
+	}
+	if n.Timeout == 0 {
+		n.Timeout = defaultNotifyTimeout
+	}
+	if n.RateWindow == 0 {
+		n.RateWindow = defaultNotifyRateWindow
+	}
+
+	return nil
+}
+
+func (f *ForwardConf) validate() error {
+	if f == nil {
+		return nil
+	}
+
+	if f.Target == "" {
+		return errors.New("missing target")
+	}
+
+	if f.MaxSize < 0 || f.MaxFiles < 0 {
+		return errors.New("invalid max_size or max_files")
+	}
+
+	if f.MaxSize == 0 {
+		f.MaxSize = defaultForwardMaxSize
+	}
+
+	if f.MaxFiles == 0 {
+		f.MaxFiles = defaultForwardMaxFiles
+	}
+
+	if msg := checkUnknown(f.XUnknown); msg != "" {
+		log.Warnf("unknown fields in forward '%s': %s", f.Target, msg)
+	}
+
+	return nil
+}
+
+const defaultPipelineQueueSize = 1000
+
+func (p *PipelineConf) validate() error {
+	if p == nil {
+		return nil
+	}
+
+	if p.Workers < 0 {
+		return errors.Errorf("invalid number of workers: %d", p.Workers)
+	}
+
+	if p.QueueSize < 0 {
+		return errors.Errorf("invalid queue size: %d", p.QueueSize)
+	}
+
+	return nil
+}
+
+// parallel return number of matching goroutines; 0 when records should be
+// processed sequentially
+func (p *PipelineConf) parallel() int {
+	if p == nil || p.Workers <= 1 {
+		return 0
+	}
+	return p.Workers
+}
+
+func (p *PipelineConf) queueSize() int {
+	if p == nil || p.QueueSize == 0 {
+		return defaultPipelineQueueSize
+	}
+	return p.QueueSize
+}
+
+// approximate check if values of metric are approximated (sampled or
+// limited)
+func (m *Metric) approximate() bool {
+	return (m.SampleRate > 0 && m.SampleRate < 1) || m.MaxPerSecond > 0
+}
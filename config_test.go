@@ -8,6 +8,10 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -103,3 +107,319 @@ func TestValidateMetricLabels(t *testing.T) {
 	}
 
 }
+
+func TestValidateForwards(t *testing.T) {
+	c := &Configuration{
+		Workers: []*WorkerConf{
+			&WorkerConf{
+				File:    "f1",
+				Forward: &ForwardConf{Target: "/tmp/fwd.log"},
+				Metrics: []*Metric{&Metric{Name: "m1"}},
+			},
+			&WorkerConf{
+				File: "f2",
+				Metrics: []*Metric{&Metric{
+					Name:    "m2",
+					Forward: &ForwardConf{Target: "/tmp/fwd.log", MaxSize: defaultForwardMaxSize},
+				}},
+			},
+		},
+	}
+	if err := c.validate(); err != nil {
+		t.Errorf("error for forwards with the same settings: %s", err)
+	}
+
+	c.Workers[1].Metrics[0].Forward.MaxFiles = 10
+	if err := c.validate(); err == nil {
+		t.Errorf("missing error for conflicting forwards")
+	}
+}
+
+func TestLoadConfigurationInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+	mainConf := filepath.Join(dir, "main.yml")
+	ioutil.WriteFile(mainConf, []byte("include: [conf.d/*.yml]\nworkers:\n  - file: f1\n    metrics:\n      - name: m1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "a.yml"), []byte("workers:\n  - file: f2\n    metrics:\n      - name: m2\n"), 0644)
+
+	c, err := LoadConfiguration(mainConf, LoadOptions{})
+	if err != nil {
+		t.Fatalf("load configuration error: %s", err)
+	}
+	if len(c.Workers) != 2 || c.Workers[1].File != "f2" {
+		t.Errorf("invalid workers: %+v", c.Workers)
+	}
+
+	// duplicated file
+	dupl := filepath.Join(dir, "conf.d", "b.yml")
+	ioutil.WriteFile(dupl, []byte("workers:\n  - file: f1\n    metrics:\n      - name: m3\n"), 0644)
+	_, err = LoadConfiguration(mainConf, LoadOptions{})
+	if err == nil || !strings.Contains(err.Error(), dupl) {
+		t.Errorf("missing or invalid error for duplicated file: %v", err)
+	}
+	os.Remove(dupl)
+
+	// section defined twice
+	ioutil.WriteFile(dupl, []byte("push:\n  url: http://a\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "c.yml"), []byte("push:\n  url: http://b\n"), 0644)
+	if _, err = LoadConfiguration(mainConf, LoadOptions{}); err == nil {
+		t.Errorf("missing error for duplicated push section")
+	}
+	os.Remove(dupl)
+	os.Remove(filepath.Join(dir, "conf.d", "c.yml"))
+
+	// additional directory and strict mode
+	extra := filepath.Join(dir, "extra")
+	os.Mkdir(extra, 0755)
+	ioutil.WriteFile(filepath.Join(extra, "d.yml"), []byte("workers:\n  - file: f3\n    unknown: 1\n    metrics:\n      - name: m3\n"), 0644)
+	c, err = LoadConfiguration(mainConf, LoadOptions{Dir: extra})
+	if err != nil || len(c.Workers) != 3 {
+		t.Errorf("invalid configuration with directory: %v", err)
+	}
+	if _, err = LoadConfiguration(mainConf, LoadOptions{Dir: extra, Strict: true}); err == nil {
+		t.Errorf("missing error for unknown field in strict mode")
+	}
+}
+
+func TestConfigurationExpand(t *testing.T) {
+	c := &Configuration{
+		PatternSets: map[string][]*Filter{
+			"errors": []*Filter{&Filter{Include: []string{"error"}}},
+		},
+		MetricTemplates: map[string]*Metric{
+			"tmpl": &Metric{
+				Name:        "t1",
+				PatternSets: []string{"errors"},
+				Labels:      map[string]string{"app": "a", "env": "prod"},
+			},
+		},
+		Workers: []*WorkerConf{
+			&WorkerConf{File: "f1", Metrics: []*Metric{
+				&Metric{Name: "m1", Template: "tmpl", Labels: map[string]string{"app": "b"}},
+				&Metric{Name: "m2", PatternSets: []string{"errors"},
+					Patterns: []*Filter{&Filter{Include: []string{"fail"}}}},
+			}},
+		},
+	}
+
+	if err := c.expand(); err != nil {
+		t.Fatalf("expand error: %s", err)
+	}
+
+	m1 := c.Workers[0].Metrics[0]
+	if m1.Name != "m1" || len(m1.Patterns) != 1 || m1.Patterns[0].Include[0] != "error" {
+		t.Errorf("invalid m1: %+v", m1)
+	}
+	if m1.Labels["app"] != "b" || m1.Labels["env"] != "prod" {
+		t.Errorf("invalid m1 labels: %v", m1.Labels)
+	}
+	if m2 := c.Workers[0].Metrics[1]; len(m2.Patterns) != 2 {
+		t.Errorf("invalid m2 patterns: %+v", m2.Patterns)
+	}
+	// templates and pattern sets are removed after expand
+	if c.MetricTemplates != nil || len(m1.PatternSets) != 0 {
+		t.Errorf("templates not removed after expand")
+	}
+
+	c.Workers[0].Metrics = append(c.Workers[0].Metrics, &Metric{Name: "m3", Template: "unknown"})
+	if err := c.expand(); err == nil {
+		t.Errorf("missing error for unknown template")
+	}
+}
+
+func TestApplyTemplateCopy(t *testing.T) {
+	patterns := make([]*Filter, 1, 4)
+	patterns[0] = &Filter{Include: []string{"error"}}
+	retries := 1
+	c := &Configuration{
+		PatternSets: map[string][]*Filter{
+			"warn": []*Filter{&Filter{Include: []string{"warn"}}},
+			"fail": []*Filter{&Filter{Include: []string{"fail"}}},
+		},
+		MetricTemplates: map[string]*Metric{
+			"tmpl": &Metric{
+				Patterns: patterns,
+				Notify:   &NotifyConf{URL: "http://a", Retries: &retries},
+			},
+		},
+		Workers: []*WorkerConf{
+			&WorkerConf{File: "f1", Metrics: []*Metric{
+				&Metric{Name: "m1", Template: "tmpl", PatternSets: []string{"warn"}},
+				&Metric{Name: "m2", Template: "tmpl", PatternSets: []string{"fail"}},
+			}},
+		},
+	}
+
+	if err := c.expand(); err != nil {
+		t.Fatalf("expand error: %s", err)
+	}
+
+	m1, m2 := c.Workers[0].Metrics[0], c.Workers[0].Metrics[1]
+	if len(m1.Patterns) != 2 || m1.Patterns[1].Include[0] != "warn" {
+		t.Errorf("invalid m1 patterns: %+v", m1.Patterns)
+	}
+	if len(m2.Patterns) != 2 || m2.Patterns[1].Include[0] != "fail" {
+		t.Errorf("invalid m2 patterns: %+v", m2.Patterns)
+	}
+
+	m1.Patterns[0].Include[0] = "changed"
+	*m1.Notify.Retries = 5
+	if m2.Patterns[0].Include[0] != "error" || patterns[0].Include[0] != "error" {
+		t.Errorf("patterns shared between metrics")
+	}
+	if *m2.Notify.Retries != 1 || retries != 1 {
+		t.Errorf("notify shared between metrics")
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	os.Setenv("LM_TEST_VAR", "value")
+	os.Setenv("LM_TEST_EMPTY", "")
+	defer os.Unsetenv("LM_TEST_VAR")
+	defer os.Unsetenv("LM_TEST_EMPTY")
+
+	secret, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secret.Name())
+	secret.WriteString("token\n")
+	secret.Close()
+	os.Setenv("LM_TEST_SECRET_FILE", secret.Name())
+	defer os.Unsetenv("LM_TEST_SECRET_FILE")
+
+	hostname, _ := os.Hostname()
+
+	tests := []struct {
+		in, out string
+	}{
+		{"abc", "abc"},
+		{"/var/log/${LM_TEST_VAR}.log", "/var/log/value.log"},
+		{"${LM_TEST_UNDEFINED:-def}", "def"},
+		{"${LM_TEST_EMPTY:-def}", "def"},
+		{"${LM_TEST_EMPTY}", ""},
+		{"${LM_TEST_VAR:-def}", "value"},
+		{"Bearer ${LM_TEST_SECRET}", "Bearer token"},
+		{"${hostname}", hostname},
+		{"$${LM_TEST_VAR}", "${LM_TEST_VAR}"},
+		{"^a$ ${LM_TEST_VAR}", "^a$ value"},
+	}
+
+	for _, tc := range tests {
+		res, err := expandVars(tc.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %s", tc.in, err)
+		} else if res != tc.out {
+			t.Errorf("%q: expected %q, got %q", tc.in, tc.out, res)
+		}
+	}
+
+	for _, in := range []string{"${LM_TEST_UNDEFINED}", "${LM_TEST_VAR", "${}"} {
+		if _, err := expandVars(in); err == nil {
+			t.Errorf("%q: missing error", in)
+		}
+	}
+}
+
+func TestDumpConfiguration(t *testing.T) {
+	os.Setenv("LM_TEST_TOKEN", "s3cr3t")
+	defer os.Unsetenv("LM_TEST_TOKEN")
+
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := filepath.Join(dir, "main.yml")
+	ioutil.WriteFile(conf, []byte("workers:\n  - file: f1\n    metrics:\n      - name: m1\n        notify:\n          url: http://hook/${LM_TEST_TOKEN}\n"), 0644)
+
+	c, err := LoadConfiguration(conf, LoadOptions{})
+	if err != nil || c.Workers[0].Metrics[0].Notify.URL != "http://hook/s3cr3t" {
+		t.Fatalf("load configuration error: %v", err)
+	}
+
+	b, err := DumpConfiguration(conf, LoadOptions{})
+	if err != nil {
+		t.Fatalf("dump configuration error: %s", err)
+	}
+	if strings.Contains(string(b), "s3cr3t") || !strings.Contains(string(b), "${LM_TEST_TOKEN}") {
+		t.Errorf("variable expanded in dump:\n%s", b)
+	}
+}
+
+func TestCheckStrict(t *testing.T) {
+	data := []byte(`
+workers:
+  - file: /var/log/messages
+    metrics:
+      - name: m1
+        patterns:
+          - include: ["error"]
+            exlude: ["debug"]
+        value_patern: "took (\\d+)"
+        labels:
+          anything: ok
+        notify:
+          url: http://localhost/
+push:
+  url: http://localhost:9091
+  intreval: 10s
+`)
+
+	err := checkStrict("test.yml", data)
+	if err == nil {
+		t.Fatalf("missing error")
+	}
+
+	for _, exp := range []string{"test.yml:8:13: unknown field 'exlude'",
+		"test.yml:9:9: unknown field 'value_patern'",
+		"test.yml:16:3: unknown field 'intreval'"} {
+		if !strings.Contains(err.Error(), exp) {
+			t.Errorf("missing %q in error: %s", exp, err)
+		}
+	}
+	if strings.Contains(err.Error(), "anything") {
+		t.Errorf("labels should not be checked: %s", err)
+	}
+
+	valid, err := ioutil.ReadFile("logmonitor.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStrict("logmonitor.yml", valid); err != nil {
+		t.Errorf("unexpected error for sample configuration: %s", err)
+	}
+}
+
+func TestConfigurationSchema(t *testing.T) {
+	schema := configurationSchema()
+	defs := schema["definitions"].(map[string]interface{})
+
+	if _, ok := schema["properties"].(map[string]interface{})["workers"]; !ok {
+		t.Errorf("missing workers in schema properties")
+	}
+
+	for _, name := range []string{"WorkerConf", "Metric", "Filter"} {
+		if _, ok := defs[name]; !ok {
+			t.Errorf("missing definition of %s", name)
+		}
+	}
+
+	props := defs["Metric"].(map[string]interface{})["properties"].(map[string]interface{})
+	for _, name := range []string{"name", "patterns", "value_pattern", "field_labels"} {
+		if _, ok := props[name]; !ok {
+			t.Errorf("missing property %s in Metric", name)
+		}
+	}
+	for _, name := range []string{"staticlabels", "xunknown", "source"} {
+		if _, ok := props[name]; ok {
+			t.Errorf("unexpected property %s in Metric", name)
+		}
+	}
+}
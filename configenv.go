@@ -0,0 +1,191 @@
+//
+// configenv.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Expanding environment variables in configuration.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// expandVars replace in `s` variables in form ${NAME} and ${NAME:-default}.
+// Value of variable is taken from environment; when NAME is not defined or
+// empty and NAME_FILE is defined - value is read from file NAME_FILE.
+// ${hostname} is replaced by name of host. "$${" is replaced by "${".
+func expandVars(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	var b bytes.Buffer
+	for {
+		idx := strings.Index(s, "${")
+		if idx < 0 {
+			b.WriteString(s)
+			break
+		}
+
+		if idx > 0 && s[idx-1] == '$' {
+			// escaped
+			b.WriteString(s[:idx])
+			b.WriteString("{")
+			s = s[idx+2:]
+			continue
+		}
+
+		b.WriteString(s[:idx])
+		s = s[idx+2:]
+
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", errors.New("missing '}'")
+		}
+
+		val, err := lookupVar(s[:end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(val)
+		s = s[end+1:]
+	}
+
+	return b.String(), nil
+}
+
+// lookupVar return value of variable `expr` (NAME or NAME:-default)
+func lookupVar(expr string) (string, error) {
+	name, def, hasDef := expr, "", false
+	if idx := strings.Index(expr, ":-"); idx >= 0 {
+		name, def, hasDef = expr[:idx], expr[idx+2:], true
+	}
+
+	if name == "" {
+		return "", errors.New("empty variable name")
+	}
+
+	if name == "hostname" {
+		h, err := os.Hostname()
+		if err != nil {
+			return "", errors.Wrap(err, "get hostname error")
+		}
+		return h, nil
+	}
+
+	val, defined := os.LookupEnv(name)
+	if val != "" {
+		return val, nil
+	}
+
+	if fname, ok := os.LookupEnv(name + "_FILE"); ok && fname != "" {
+		content, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return "", errors.Wrapf(err, "read %s_FILE error", name)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	if hasDef {
+		return def, nil
+	}
+
+	if defined {
+		return "", nil
+	}
+
+	return "", errors.Errorf("undefined variable '%s'", name)
+}
+
+// expandVarsMap expand variables in map values
+func expandVarsMap(m map[string]string) error {
+	for k, v := range m {
+		val, err := expandVars(v)
+		if err != nil {
+			return errors.Wrapf(err, "'%s'", k)
+		}
+		m[k] = val
+	}
+	return nil
+}
+
+// expandEnv expand variables in file names, labels, urls and options
+func (c *Configuration) expandEnv() error {
+	var err error
+
+	for i, f := range c.Workers {
+		if f.File, err = expandVars(f.File); err != nil {
+			return errors.Wrapf(err, "%s: file", f.location(i))
+		}
+		if f.StampFile, err = expandVars(f.StampFile); err != nil {
+			return errors.Wrapf(err, "%s: stamp_file", f.location(i))
+		}
+		if err = expandVarsMap(f.Options); err != nil {
+			return errors.Wrapf(err, "%s: options", f.location(i))
+		}
+		if err = f.Forward.expandEnv(); err != nil {
+			return errors.Wrapf(err, "%s: forward", f.location(i))
+		}
+
+		for j, m := range f.Metrics {
+			if err = expandVarsMap(m.Labels); err != nil {
+				return errors.Wrapf(err, "%s metric %d: labels", f.location(i), j+1)
+			}
+			if m.Notify != nil {
+				if m.Notify.URL, err = expandVars(m.Notify.URL); err != nil {
+					return errors.Wrapf(err, "%s metric %d: notify url", f.location(i), j+1)
+				}
+			}
+			if err = m.Forward.expandEnv(); err != nil {
+				return errors.Wrapf(err, "%s metric %d: forward", f.location(i), j+1)
+			}
+		}
+	}
+
+	if p := c.Push; p != nil {
+		if p.URL, err = expandVars(p.URL); err != nil {
+			return errors.Wrap(err, "push: url")
+		}
+		if p.Job, err = expandVars(p.Job); err != nil {
+			return errors.Wrap(err, "push: job")
+		}
+		if err = expandVarsMap(p.Grouping); err != nil {
+			return errors.Wrap(err, "push: grouping")
+		}
+	}
+
+	if r := c.RemoteWrite; r != nil {
+		if r.URL, err = expandVars(r.URL); err != nil {
+			return errors.Wrap(err, "remote_write: url")
+		}
+		if err = expandVarsMap(r.ExternalLabels); err != nil {
+			return errors.Wrap(err, "remote_write: external_labels")
+		}
+	}
+
+	if t := c.Textfile; t != nil {
+		if t.Path, err = expandVars(t.Path); err != nil {
+			return errors.Wrap(err, "textfile: path")
+		}
+	}
+
+	for i, o := range c.Outputs {
+		if err = expandVarsMap(o.Options); err != nil {
+			return errors.Wrapf(err, "output %d: options", i+1)
+		}
+	}
+
+	return nil
+}
+
+func (f *ForwardConf) expandEnv() (err error) {
+	if f != nil {
+		f.Target, err = expandVars(f.Target)
+	}
+	return
+}
@@ -0,0 +1,143 @@
+//
+// configexpand.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Expanding metric templates and pattern sets in configuration.
+
+package main
+
+import (
+	"github.com/pkg/errors"
+)
+
+// expand apply metric templates and pattern sets to all metrics. After
+// expanding templates and pattern sets are removed from configuration.
+func (c *Configuration) expand() error {
+	for _, mt := range c.MetricTemplates {
+		if mt.Template != "" {
+			return errors.New("templates can't use other templates")
+		}
+	}
+
+	for i, f := range c.Workers {
+		for j, m := range f.Metrics {
+			if m.Template != "" {
+				t, ok := c.MetricTemplates[m.Template]
+				if !ok {
+					return errors.Errorf("unknown template '%s' in %s metric %d",
+						m.Template, f.location(i), j+1)
+				}
+				m.applyTemplate(t)
+			}
+
+			for _, name := range m.PatternSets {
+				ps, ok := c.PatternSets[name]
+				if !ok {
+					return errors.Errorf("unknown pattern set '%s' in %s metric %d",
+						name, f.location(i), j+1)
+				}
+				m.Patterns = append(m.Patterns, copyFilters(ps)...)
+			}
+			m.PatternSets = nil
+		}
+	}
+
+	c.MetricTemplates = nil
+	c.PatternSets = nil
+
+	return nil
+}
+
+// applyTemplate set metric fields not defined in metric from template `t`;
+// labels are merged (metric labels override template labels). Values from
+// template are copied, so metrics don't share them.
+func (m *Metric) applyTemplate(t *Metric) {
+	res := *t
+
+	if m.Name != "" {
+		res.Name = m.Name
+	}
+	if len(m.Patterns) > 0 {
+		res.Patterns = m.Patterns
+	} else {
+		res.Patterns = copyFilters(t.Patterns)
+	}
+	res.PatternSets = append(append([]string(nil), t.PatternSets...), m.PatternSets...)
+	res.Disabled = m.Disabled
+	res.Labels = mergeLabels(t.Labels, m.Labels)
+	res.FieldLabels = mergeLabels(t.FieldLabels, m.FieldLabels)
+
+	if m.ValuePattern != "" {
+		res.ValuePattern = m.ValuePattern
+	}
+	if m.ValueField != "" {
+		res.ValueField = m.ValueField
+	}
+	if m.SampleRate != 0 {
+		res.SampleRate = m.SampleRate
+	}
+	if m.MaxPerSecond != 0 {
+		res.MaxPerSecond = m.MaxPerSecond
+	}
+	if m.LimitMatched {
+		res.LimitMatched = true
+	}
+	// notify and forward are modified by validate and variables expansion
+	if m.Notify != nil {
+		res.Notify = m.Notify
+	} else if t.Notify != nil {
+		n := *t.Notify
+		if t.Notify.Retries != nil {
+			retries := *t.Notify.Retries
+			n.Retries = &retries
+		}
+		res.Notify = &n
+	}
+	if m.Forward != nil {
+		res.Forward = m.Forward
+	} else if t.Forward != nil {
+		f := *t.Forward
+		res.Forward = &f
+	}
+	if m.Samples != 0 {
+		res.Samples = m.Samples
+	}
+
+	res.Template = ""
+	*m = res
+}
+
+// copyFilters return deep copy of `filters`
+func copyFilters(filters []*Filter) []*Filter {
+	if filters == nil {
+		return nil
+	}
+
+	res := make([]*Filter, len(filters))
+	for i, f := range filters {
+		if f == nil {
+			continue
+		}
+		c := *f
+		c.Include = append([]string(nil), f.Include...)
+		c.Exclude = append([]string(nil), f.Exclude...)
+		res[i] = &c
+	}
+	return res
+}
+
+// mergeLabels create new map with labels from `base` overridden by `over`
+func mergeLabels(base, over map[string]string) map[string]string {
+	if len(base) == 0 && len(over) == 0 {
+		return over
+	}
+
+	res := make(map[string]string, len(base)+len(over))
+	for k, v := range base {
+		res[k] = v
+	}
+	for k, v := range over {
+		res[k] = v
+	}
+	return res
+}
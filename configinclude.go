@@ -0,0 +1,124 @@
+//
+// configinclude.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Loading additional configuration files (include, -config.dir).
+
+package main
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// includedFiles return sorted list of files matching `patterns` (relative
+// to directory of `mainFile`) and *.yml, *.yaml files from `dir`. Main
+// configuration file is skipped.
+func includedFiles(mainFile string, patterns []string, dir string) ([]string, error) {
+	base := filepath.Dir(mainFile)
+	mainAbs, _ := filepath.Abs(mainFile)
+
+	var files []string
+	seen := make(map[string]bool)
+
+	add := func(pattern string) error {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "invalid pattern '%s'", pattern)
+		}
+		sort.Strings(matches)
+
+		for _, m := range matches {
+			abs, _ := filepath.Abs(m)
+			if abs == mainAbs || seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			files = append(files, m)
+		}
+		return nil
+	}
+
+	for _, p := range patterns {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(base, p)
+		}
+		if err := add(p); err != nil {
+			return nil, err
+		}
+	}
+
+	if dir != "" {
+		for _, ext := range []string{"*.yml", "*.yaml"} {
+			if err := add(filepath.Join(dir, ext)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// merge add to configuration workers, outputs, pattern sets and metric
+// templates from configuration `ic` loaded from `filename`. Push,
+// remote_write and textfile sections can be defined only once.
+func (c *Configuration) merge(ic *Configuration, filename string) error {
+	if len(ic.Include) > 0 {
+		return errors.New("nested include is not supported")
+	}
+
+	if msg := checkUnknown(ic.XUnknown); msg != "" {
+		log.Warnf("unknown fields in configuraton %s: %s", filename, msg)
+	}
+
+	sections := []struct {
+		name           string
+		main, included bool
+	}{
+		{"push", c.Push != nil, ic.Push != nil},
+		{"remote_write", c.RemoteWrite != nil, ic.RemoteWrite != nil},
+		{"textfile", c.Textfile != nil, ic.Textfile != nil},
+	}
+	for _, s := range sections {
+		if s.main && s.included {
+			return errors.Errorf("section '%s' already defined", s.name)
+		}
+	}
+
+	if ic.Push != nil {
+		c.Push = ic.Push
+	}
+	if ic.RemoteWrite != nil {
+		c.RemoteWrite = ic.RemoteWrite
+	}
+	if ic.Textfile != nil {
+		c.Textfile = ic.Textfile
+	}
+
+	for name, ps := range ic.PatternSets {
+		if _, exists := c.PatternSets[name]; exists {
+			return errors.Errorf("pattern set '%s' already defined", name)
+		}
+		if c.PatternSets == nil {
+			c.PatternSets = make(map[string][]*Filter)
+		}
+		c.PatternSets[name] = ps
+	}
+
+	for name, mt := range ic.MetricTemplates {
+		if _, exists := c.MetricTemplates[name]; exists {
+			return errors.Errorf("metric template '%s' already defined", name)
+		}
+		if c.MetricTemplates == nil {
+			c.MetricTemplates = make(map[string]*Metric)
+		}
+		c.MetricTemplates[name] = mt
+	}
+
+	c.Workers = append(c.Workers, ic.Workers...)
+	c.Outputs = append(c.Outputs, ic.Outputs...)
+
+	return nil
+}
@@ -0,0 +1,202 @@
+//
+// configschema.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Strict checking of configuration files and JSON Schema of configuration.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// yamlFieldName return name of field in yaml (the same rules as in
+// yaml.v2); empty name for skipped and inlined fields
+func yamlFieldName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		// unexported
+		return ""
+	}
+
+	tag := f.Tag.Get("yaml")
+	if tag == "-" {
+		return ""
+	}
+
+	parts := strings.Split(tag, ",")
+	for _, p := range parts[1:] {
+		if p == "inline" {
+			return ""
+		}
+	}
+
+	if parts[0] != "" {
+		return parts[0]
+	}
+	return strings.ToLower(f.Name)
+}
+
+// yamlFields return fields of struct `t` by yaml name
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if name := yamlFieldName(f); name != "" {
+			fields[name] = f
+		}
+	}
+	return fields
+}
+
+// checkStrict find in configuration file content unknown fields; error
+// contains file name, line and column of each unknown field
+func checkStrict(filename string, data []byte) error {
+	var root yamlv3.Node
+	if err := yamlv3.Unmarshal(data, &root); err != nil {
+		return errors.Wrap(err, "parse error")
+	}
+
+	var errs []string
+	checkNode(filename, &root, reflect.TypeOf(Configuration{}), &errs)
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func checkNode(filename string, n *yamlv3.Node, t reflect.Type, errs *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch n.Kind {
+	case yamlv3.DocumentNode:
+		for _, c := range n.Content {
+			checkNode(filename, c, t, errs)
+		}
+		return
+	case yamlv3.AliasNode:
+		checkNode(filename, n.Alias, t, errs)
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yamlv3.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if key.Value == "<<" {
+				// merge key
+				checkNode(filename, value, t, errs)
+				continue
+			}
+			f, ok := fields[key.Value]
+			if !ok {
+				*errs = append(*errs, fmt.Sprintf("%s:%d:%d: unknown field '%s'",
+					filename, key.Line, key.Column, key.Value))
+				continue
+			}
+			checkNode(filename, value, f.Type, errs)
+		}
+
+	case reflect.Slice:
+		if n.Kind != yamlv3.SequenceNode {
+			return
+		}
+		for _, c := range n.Content {
+			checkNode(filename, c, t.Elem(), errs)
+		}
+
+	case reflect.Map:
+		if n.Kind != yamlv3.MappingNode {
+			return
+		}
+		for i := 1; i < len(n.Content); i += 2 {
+			checkNode(filename, n.Content[i], t.Elem(), errs)
+		}
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// configurationSchema generate JSON Schema (draft-07) of configuration file
+func configurationSchema() map[string]interface{} {
+	defs := make(map[string]interface{})
+	typeSchema(reflect.TypeOf(Configuration{}), defs)
+
+	// root is Configuration; other structures are in definitions
+	schema := defs["Configuration"].(map[string]interface{})
+	delete(defs, "Configuration")
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "logmonitor configuration"
+	schema["definitions"] = defs
+
+	return schema
+}
+
+// typeSchema return schema for type `t`; structures are added to `defs`
+// and referenced by name
+func typeSchema(t reflect.Type, defs map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == durationType {
+		// duration as string (i.e. 10s) or number of nanoseconds
+		return map[string]interface{}{"type": []string{"string", "integer"}}
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		ref := map[string]interface{}{"$ref": "#/definitions/" + t.Name()}
+		if _, ok := defs[t.Name()]; ok {
+			return ref
+		}
+		props := make(map[string]interface{})
+		schema := map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+		// placeholder for recursive types
+		defs[t.Name()] = schema
+		for name, f := range yamlFields(t) {
+			props[name] = typeSchema(f.Type, defs)
+		}
+		return ref
+
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  []string{"array", "null"},
+			"items": typeSchema(t.Elem(), defs),
+		}
+
+	case reflect.Map:
+		return map[string]interface{}{
+			"type":                 []string{"object", "null"},
+			"additionalProperties": typeSchema(t.Elem(), defs),
+		}
+
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+
+	return map[string]interface{}{}
+}
@@ -0,0 +1,180 @@
+//
+// configwatch.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Watching configuration files for changes.
+
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/fsnotify.v1"
+)
+
+const defaultConfigWatchDelay = 2 * time.Second
+
+// ConfigWatcher watch main configuration file and included files (also
+// new files matching include patterns) and notify about changes by C.
+// Directories are watched so files replaced by editors are also detected.
+type ConfigWatcher struct {
+	// C receive notification when configuration files changed
+	C chan struct{}
+
+	// delay is time of waiting for next changes before notification
+	delay   time.Duration
+	watcher *fsnotify.Watcher
+
+	mu sync.Mutex
+	// mainFile is absolute path of main configuration file
+	mainFile string
+	// patterns are absolute glob patterns of included files
+	patterns []string
+	// dirs are watched directories
+	dirs map[string]bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewConfigWatcher create and start watcher; changes are reported after
+// `delay` without other changes
+func NewConfigWatcher(delay time.Duration) (*ConfigWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "create watcher error")
+	}
+
+	cw := &ConfigWatcher{
+		C:       make(chan struct{}, 1),
+		delay:   delay,
+		watcher: w,
+		dirs:    make(map[string]bool),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	go cw.loop()
+
+	return cw, nil
+}
+
+// Watch set files to watch: main configuration file `mainFile`, files
+// included by `c` and files from `dir`
+func (cw *ConfigWatcher) Watch(mainFile string, c *Configuration, dir string) error {
+	mainAbs, err := filepath.Abs(mainFile)
+	if err != nil {
+		return errors.Wrap(err, "invalid configuration file path")
+	}
+
+	base := filepath.Dir(mainAbs)
+	var patterns []string
+	for _, p := range c.Include {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(base, p)
+		}
+		patterns = append(patterns, p)
+	}
+	if dir != "" {
+		if dir, err = filepath.Abs(dir); err != nil {
+			return errors.Wrap(err, "invalid configuration directory")
+		}
+		patterns = append(patterns, filepath.Join(dir, "*.yml"), filepath.Join(dir, "*.yaml"))
+	}
+
+	dirs := map[string]bool{base: true}
+	for _, p := range patterns {
+		dirs[filepath.Dir(p)] = true
+	}
+
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	cw.mainFile = mainAbs
+	cw.patterns = patterns
+
+	for d := range cw.dirs {
+		if !dirs[d] {
+			cw.watcher.Remove(d)
+			delete(cw.dirs, d)
+		}
+	}
+
+	for d := range dirs {
+		if cw.dirs[d] {
+			continue
+		}
+		if err := cw.watcher.Add(d); err != nil {
+			// i.e. directory with glob pattern or not existing directory
+			log.Warnf("watching '%s' for configuration changes error: %s", d, err)
+			continue
+		}
+		cw.dirs[d] = true
+	}
+
+	return nil
+}
+
+// Stop watching
+func (cw *ConfigWatcher) Stop() {
+	if cw == nil {
+		return
+	}
+
+	close(cw.stop)
+	<-cw.done
+	cw.watcher.Close()
+}
+
+// match check is `name` one of configuration files
+func (cw *ConfigWatcher) match(name string) bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if name == cw.mainFile {
+		return true
+	}
+
+	for _, p := range cw.patterns {
+		if ok, _ := filepath.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (cw *ConfigWatcher) loop() {
+	defer close(cw.done)
+
+	var timer <-chan time.Time
+
+	for {
+		select {
+		case ev := <-cw.watcher.Events:
+			if ev.Op == fsnotify.Chmod || !cw.match(filepath.Clean(ev.Name)) {
+				continue
+			}
+			log.Debugf("configuration file changed: %s", ev)
+			// wait for next changes
+			timer = time.After(cw.delay)
+
+		case err := <-cw.watcher.Errors:
+			log.Errorf("watching configuration error: %s", err)
+
+		case <-timer:
+			timer = nil
+			select {
+			case cw.C <- struct{}{}:
+			default:
+				// reload already pending
+			}
+
+		case <-cw.stop:
+			return
+		}
+	}
+}
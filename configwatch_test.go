@@ -0,0 +1,69 @@
+//
+// configwatch_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configwatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	mainFile := filepath.Join(dir, "logmonitor.yml")
+	ioutil.WriteFile(mainFile, []byte("workers: []\n"), 0644)
+	os.Mkdir(filepath.Join(dir, "conf.d"), 0755)
+
+	cw, err := NewConfigWatcher(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Stop()
+
+	c := &Configuration{Include: []string{"conf.d/*.yml"}}
+	if err := cw.Watch(mainFile, c, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(name string, changed bool) {
+		select {
+		case <-cw.C:
+			if !changed {
+				t.Errorf("%s: unexpected notification", name)
+			}
+		case <-time.After(500 * time.Millisecond):
+			if changed {
+				t.Errorf("%s: missing notification", name)
+			}
+		}
+	}
+
+	// many changes - one notification
+	for i := 0; i < 3; i++ {
+		ioutil.WriteFile(mainFile, []byte("workers: []\n"), 0644)
+		time.Sleep(20 * time.Millisecond)
+	}
+	expect("main file", true)
+	expect("main file debounce", false)
+
+	// new included file
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "a.yml"), []byte("workers: []\n"), 0644)
+	expect("included file", true)
+
+	// other files are ignored
+	ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "conf.d", "a.txt"), []byte("a"), 0644)
+	expect("other files", false)
+}
@@ -0,0 +1,306 @@
+//
+// containerlog.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Reader for log files created by Docker (json-file logging driver) and CRI
+// compatible container runtimes.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/hpcloud/tail"
+	"github.com/pkg/errors"
+)
+
+const (
+	containerFormatDocker = "docker"
+	containerFormatCRI    = "cri"
+
+	// containerDefaultLabel is name of label that get container id
+	containerDefaultLabel = "container_id"
+
+	// maximal size of line assembled from partial lines
+	containerMaxLineSize = 1024 * 1024
+)
+
+var containerIDRe = regexp.MustCompile(`[0-9a-f]{64}$`)
+
+// containerLine is one line unwrapped from container log
+type containerLine struct {
+	stream string
+	time   time.Time
+	text   string
+}
+
+// ContainerLogReader read container log files written as json
+// (`{"log":...,"stream":...,"time":...}`) or in CRI format
+// (`<time> <stream> <tag> <message>`) and join partial lines.
+type ContainerLogReader struct {
+	c *WorkerConf
+	t *tail.Tail
+
+	format      string
+	containerID string
+	streams     map[string]bool
+	// partial lines by stream
+	partial map[string]*containerLine
+
+	log logger
+}
+
+func init() {
+	MustRegisterReader(&ContainerLogReader{})
+}
+
+// containerLogFormat return format of container log defined in options
+// or detected by file path.
+func containerLogFormat(conf *WorkerConf) string {
+	if f, ok := conf.Options["format"]; ok {
+		return f
+	}
+
+	switch {
+	case strings.HasPrefix(conf.File, "/var/lib/docker/containers/") &&
+		strings.HasSuffix(conf.File, "-json.log"):
+		return containerFormatDocker
+	case strings.HasPrefix(conf.File, "/var/log/containers/"),
+		strings.HasPrefix(conf.File, "/var/log/pods/"):
+		return containerFormatCRI
+	}
+
+	return ""
+}
+
+// containerIDFromPath find container id in log file path.
+// For kubernetes /var/log/pods/<pod>/<container>/<n>.log files name of
+// container is returned.
+func containerIDFromPath(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, "-json.log")
+	name = strings.TrimSuffix(name, ".log")
+
+	if id := containerIDRe.FindString(name); id != "" {
+		return id
+	}
+
+	dir := filepath.Base(filepath.Dir(path))
+	if id := containerIDRe.FindString(dir); id != "" {
+		return id
+	}
+
+	if strings.HasPrefix(path, "/var/log/pods/") {
+		return dir
+	}
+
+	return ""
+}
+
+// Match reader to configuration file.
+// Reader is used when `format` option is set to docker or cri or file is
+// in one of default container logs directories.
+func (c *ContainerLogReader) Match(conf *WorkerConf) (prio int) {
+	if conf.File == "" || conf.File[0] == ':' {
+		return -1
+	}
+
+	switch containerLogFormat(conf) {
+	case containerFormatDocker, containerFormatCRI:
+		return 50
+	}
+
+	return -1
+}
+
+// Labels return static labels for metrics read from container log.
+// Label with container id is added only when enabled by `container_label`
+// option (name of label or "yes" for "container_id"); metrics with the
+// same name in other workers must define the same label.
+func (c *ContainerLogReader) Labels(conf *WorkerConf) map[string]string {
+	label := conf.Options["container_label"]
+	switch label {
+	case "", "no":
+		return nil
+	case "yes":
+		label = containerDefaultLabel
+	}
+
+	if id := containerIDFromPath(conf.File); id != "" {
+		return map[string]string{label: id}
+	}
+
+	return nil
+}
+
+// Create new reader for container log files
+func (c *ContainerLogReader) Create(conf *WorkerConf, l logger) (Reader, error) {
+	l.Infof("Monitoring '%s' by Container Log Reader", conf.File)
+
+	r := &ContainerLogReader{
+		c:           conf,
+		format:      containerLogFormat(conf),
+		containerID: containerIDFromPath(conf.File),
+		streams:     map[string]bool{"stdout": true, "stderr": true},
+		partial:     make(map[string]*containerLine),
+		log:         l,
+	}
+
+	switch s := conf.Options["stream"]; s {
+	case "", "both":
+	case "stdout", "stderr":
+		r.streams = map[string]bool{s: true}
+	default:
+		return nil, errors.Errorf("invalid stream '%s'; use stdout, stderr or both", s)
+	}
+
+	return r, nil
+}
+
+// Start reading file
+func (c *ContainerLogReader) Start(ctx context.Context) (err error) {
+	if c.t != nil {
+		return errors.Errorf("already reading")
+	}
+
+	c.t, err = tailFile(c.c, &tail.SeekInfo{Offset: 0, Whence: os.SEEK_END})
+
+	return errors.Wrap(err, "open file error")
+}
+
+// Stop reading file
+func (c *ContainerLogReader) Stop() error {
+	if c.t != nil {
+		c.t.Stop()
+		c.t = nil
+	}
+	return nil
+}
+
+func (c *ContainerLogReader) Read(ctx context.Context) (rec *Record, err error) {
+	if c.t == nil {
+		return nil, errors.New("file not opened")
+	}
+
+	for {
+		var l *tail.Line
+		var ok bool
+
+		select {
+		case l, ok = <-c.t.Lines:
+			if !ok {
+				return nil, io.EOF
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		if l.Err != nil {
+			return nil, errors.Wrap(l.Err, "read line error")
+		}
+
+		var cl *containerLine
+		var partial bool
+		if c.format == containerFormatDocker {
+			cl, partial, err = parseDockerLogLine(l.Text)
+		} else {
+			cl, partial, err = parseCRILogLine(l.Text)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if cl = c.assemble(cl, partial); cl == nil {
+			continue
+		}
+
+		if c.streams[cl.stream] {
+			return &Record{
+				Message: cl.text,
+				Fields: map[string]string{
+					"STREAM":       cl.stream,
+					"CONTAINER_ID": c.containerID,
+				},
+				Time:   cl.time,
+				Source: c.c.File,
+			}, nil
+		}
+	}
+}
+
+// assemble join partial lines; return nil when line is not completed yet.
+func (c *ContainerLogReader) assemble(cl *containerLine, partial bool) *containerLine {
+	prev, ok := c.partial[cl.stream]
+	if ok {
+		prev.text += cl.text
+		cl = prev
+	}
+
+	if partial && len(cl.text) < containerMaxLineSize {
+		c.partial[cl.stream] = cl
+		return nil
+	}
+
+	delete(c.partial, cl.stream)
+	return cl
+}
+
+// parseDockerLogLine unwrap line written by docker json-file logging driver.
+// Lines not ended by new line are partial.
+func parseDockerLogLine(data string) (cl *containerLine, partial bool, err error) {
+	var entry struct {
+		Log    string    `json:"log"`
+		Stream string    `json:"stream"`
+		Time   time.Time `json:"time"`
+	}
+
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		return nil, false, errors.Wrap(err, "decode docker log line error")
+	}
+
+	cl = &containerLine{
+		stream: entry.Stream,
+		time:   entry.Time,
+		text:   strings.TrimSuffix(entry.Log, "\n"),
+	}
+
+	return cl, !strings.HasSuffix(entry.Log, "\n"), nil
+}
+
+// parseCRILogLine parse line in CRI format: `<time> <stream> <tags> <message>`.
+// Tags is list separated by ":"; first tag define partial (P) or full (F) line.
+func parseCRILogLine(data string) (cl *containerLine, partial bool, err error) {
+	parts := strings.SplitN(data, " ", 4)
+	if len(parts) < 3 {
+		return nil, false, errors.Errorf("invalid cri log line: '%s'", data)
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, false, errors.Wrap(err, "parse cri log time error")
+	}
+
+	cl = &containerLine{
+		stream: parts[1],
+		time:   ts,
+	}
+
+	if len(parts) == 4 {
+		cl.text = parts[3]
+	}
+
+	tag := parts[2]
+	if idx := strings.IndexRune(tag, ':'); idx >= 0 {
+		tag = tag[:idx]
+	}
+
+	return cl, tag == "P", nil
+}
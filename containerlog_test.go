@@ -0,0 +1,106 @@
+//
+// containerlog_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"testing"
+)
+
+const testContainerID = "4a7b3c1f0e2d5a6b8c9d0e1f2a3b4c5d6e7f8a9b0c1d2e3f4a5b6c7d8e9f0a1b"
+
+func TestParseDockerLogLine(t *testing.T) {
+	cl, partial, err := parseDockerLogLine(
+		`{"log":"error: something\n","stream":"stderr","time":"2017-09-01T10:11:12.123456789Z"}`)
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	if partial || cl.text != "error: something" || cl.stream != "stderr" || cl.time.Year() != 2017 {
+		t.Errorf("invalid result: %+v, %v", cl, partial)
+	}
+
+	cl, partial, err = parseDockerLogLine(`{"log":"part","stream":"stdout","time":"2017-09-01T10:11:12Z"}`)
+	if err != nil || !partial || cl.text != "part" {
+		t.Errorf("invalid result for partial line: %+v, %v, %v", cl, partial, err)
+	}
+
+	if _, _, err = parseDockerLogLine("plain text"); err == nil {
+		t.Errorf("missing error for invalid line")
+	}
+}
+
+func TestParseCRILogLine(t *testing.T) {
+	cl, partial, err := parseCRILogLine("2017-09-01T10:11:12.123456789+02:00 stdout F message with spaces")
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	if partial || cl.text != "message with spaces" || cl.stream != "stdout" {
+		t.Errorf("invalid result: %+v, %v", cl, partial)
+	}
+
+	cl, partial, err = parseCRILogLine("2017-09-01T10:11:12Z stderr P")
+	if err != nil || !partial || cl.text != "" || cl.stream != "stderr" {
+		t.Errorf("invalid result for partial line: %+v, %v, %v", cl, partial, err)
+	}
+
+	if _, _, err = parseCRILogLine("not a cri line"); err == nil {
+		t.Errorf("missing error for invalid line")
+	}
+}
+
+func TestContainerLogAssemble(t *testing.T) {
+	c := &ContainerLogReader{partial: make(map[string]*containerLine)}
+
+	if cl := c.assemble(&containerLine{stream: "stdout", text: "first "}, true); cl != nil {
+		t.Errorf("partial line returned: %+v", cl)
+	}
+	if cl := c.assemble(&containerLine{stream: "stderr", text: "other"}, false); cl == nil || cl.text != "other" {
+		t.Errorf("invalid line from other stream: %+v", cl)
+	}
+	if cl := c.assemble(&containerLine{stream: "stdout", text: "second"}, false); cl == nil || cl.text != "first second" {
+		t.Errorf("invalid assembled line: %+v", cl)
+	}
+	if len(c.partial) != 0 {
+		t.Errorf("partial lines not cleared: %+v", c.partial)
+	}
+}
+
+func TestContainerIDFromPath(t *testing.T) {
+	paths := map[string]string{
+		"/var/lib/docker/containers/" + testContainerID + "/" + testContainerID + "-json.log": testContainerID,
+		"/var/log/containers/pod_default_app-" + testContainerID + ".log":                     testContainerID,
+		"/var/log/pods/default_pod_1234/app/0.log":                                            "app",
+		"/var/log/messages": "",
+	}
+
+	for path, id := range paths {
+		if res := containerIDFromPath(path); res != id {
+			t.Errorf("invalid id for %s: %q, expected %q", path, res, id)
+		}
+	}
+}
+
+func TestContainerLogLabels(t *testing.T) {
+	c := &ContainerLogReader{}
+	file := "/var/log/containers/pod_default_app-" + testContainerID + ".log"
+
+	tests := map[string]string{"": "", "no": "", "yes": "container_id", "cid": "cid"}
+	for opt, label := range tests {
+		labels := c.Labels(&WorkerConf{File: file, Options: map[string]string{"container_label": opt}})
+		if label == "" {
+			if len(labels) != 0 {
+				t.Errorf("option '%s': unexpected labels %v", opt, labels)
+			}
+		} else if labels[label] != testContainerID {
+			t.Errorf("option '%s': invalid labels %v", opt, labels)
+		}
+	}
+
+	if prio := c.Match(&WorkerConf{}); prio >= 0 {
+		t.Errorf("empty file matched: %d", prio)
+	}
+}
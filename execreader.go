@@ -0,0 +1,326 @@
+//
+// execreader.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Reader that launch command and read its output.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	execPrefix = ":exec/"
+
+	execMinRestartDelay = time.Second
+	execMaxRestartDelay = time.Minute
+
+	execMaxLineSize = 1024 * 1024
+
+	// time to wait for command exit after SIGTERM
+	execKillTimeout = 5 * time.Second
+	// time for reading output remaining in pipes after command exit;
+	// children of command may keep pipes open
+	execDrainTimeout = 100 * time.Millisecond
+)
+
+// execLine is one line read from command output
+type execLine struct {
+	stream string
+	time   time.Time
+	text   string
+}
+
+// ExecReader launch command defined as `:exec/<command>` and read lines from
+// its stdout and stderr. Command is restarted when exit.
+type ExecReader struct {
+	c       *WorkerConf
+	command string
+	streams map[string]bool
+
+	lines   chan execLine
+	wg      sync.WaitGroup
+	started bool
+
+	log logger
+}
+
+func init() {
+	MustRegisterReader(&ExecReader{})
+}
+
+// Match reader to configuration file.
+func (e *ExecReader) Match(conf *WorkerConf) (prio int) {
+	if strings.HasPrefix(conf.File, execPrefix) {
+		return 99
+	}
+	return -1
+}
+
+// Create new reader for command output
+func (e *ExecReader) Create(conf *WorkerConf, l logger) (Reader, error) {
+	l.Infof("Monitoring '%s' by Exec Reader", conf.File)
+
+	command := strings.TrimSpace(conf.File[len(execPrefix):])
+	if command == "" {
+		return nil, errors.Errorf("missing command in '%s'", conf.File)
+	}
+
+	r := &ExecReader{
+		c:       conf,
+		command: command,
+		streams: map[string]bool{"stdout": true, "stderr": true},
+		log:     l,
+	}
+
+	switch s := conf.Options["stream"]; s {
+	case "", "both":
+	case "stdout", "stderr":
+		r.streams = map[string]bool{s: true}
+	default:
+		return nil, errors.Errorf("invalid stream '%s'; use stdout, stderr or both", s)
+	}
+
+	return r, nil
+}
+
+// Start command
+func (e *ExecReader) Start(ctx context.Context) error {
+	if e.started {
+		return errors.Errorf("already reading")
+	}
+
+	e.started = true
+	e.lines = make(chan execLine, 100)
+
+	e.wg.Add(1)
+	go e.run(ctx)
+
+	return nil
+}
+
+// run launch command and restart it with backoff when exit
+func (e *ExecReader) run(ctx context.Context) {
+	defer e.wg.Done()
+
+	if *runOnce {
+		// in once mode run command only once; end of output is end of input
+		defer close(e.lines)
+		if err := e.execute(ctx); err != nil {
+			e.log.Warnf("command '%s' error: %s", e.command, err)
+		}
+		return
+	}
+
+	delay := execMinRestartDelay
+
+	for {
+		started := time.Now()
+		err := e.execute(ctx)
+		if ctx.Err() != nil {
+			// stopped
+			return
+		}
+
+		if err != nil {
+			e.log.Warnf("command '%s' error: %s", e.command, err)
+		} else {
+			e.log.Infof("command '%s' finished", e.command)
+		}
+
+		// reset backoff when command was running long enough
+		if time.Since(started) > execMaxRestartDelay {
+			delay = execMinRestartDelay
+		}
+
+		e.log.Debugf("restarting command in %s", delay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > execMaxRestartDelay {
+			delay = execMaxRestartDelay
+		}
+	}
+}
+
+// execute run command and wait for finish. When context is cancelled
+// command is terminated.
+func (e *ExecReader) execute(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", e.command)
+	// run in new process group to allow kill command with its children
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	// os pipes are used so cmd.Wait don't wait for closing output by
+	// children of command
+	stdout, stdoutW, err := os.Pipe()
+	if err != nil {
+		return errors.Wrap(err, "create stdout pipe error")
+	}
+	defer stdout.Close()
+
+	stderr, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutW.Close()
+		return errors.Wrap(err, "create stderr pipe error")
+	}
+	defer stderr.Close()
+
+	cmd.Stdout, cmd.Stderr = stdoutW, stderrW
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		return errors.Wrap(err, "start command error")
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go e.terminateOnCancel(ctx, cmd, finished)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go e.readStream(ctx, &wg, "stdout", stdout)
+	go e.readStream(ctx, &wg, "stderr", stderr)
+
+	err = cmd.Wait()
+
+	// read remaining output and stop reading
+	deadline := time.Now().Add(execDrainTimeout)
+	stdout.SetReadDeadline(deadline)
+	stderr.SetReadDeadline(deadline)
+	wg.Wait()
+
+	return err
+}
+
+// terminateOnCancel send SIGTERM to command when context is cancelled and
+// SIGKILL when command not finish in execKillTimeout.
+func (e *ExecReader) terminateOnCancel(ctx context.Context, cmd *exec.Cmd,
+	finished <-chan struct{}) {
+	select {
+	case <-finished:
+		return
+	case <-ctx.Done():
+	}
+
+	// kill whole process group
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+
+	select {
+	case <-finished:
+	case <-time.After(execKillTimeout):
+		e.log.Warnf("command '%s' not finished; killing", e.command)
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+func (e *ExecReader) readStream(ctx context.Context, wg *sync.WaitGroup,
+	stream string, r io.Reader) {
+	defer wg.Done()
+
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	for {
+		line, truncated, err := readLimitedLine(br, execMaxLineSize)
+		if err != nil {
+			if err == io.EOF {
+				return
+			}
+			if os.IsTimeout(err) {
+				e.log.Debugf("command exited; %s still open by child process", stream)
+				return
+			}
+			e.log.Infof("read %s error: %s", stream, err)
+			io.Copy(ioutil.Discard, r)
+			return
+		}
+
+		if truncated {
+			e.log.Infof("read %s error: line longer than %d bytes truncated", stream, execMaxLineSize)
+			ObserveReadError(e.c.File)
+		}
+
+		if !e.streams[stream] {
+			continue
+		}
+
+		select {
+		case e.lines <- execLine{stream: stream, time: time.Now(), text: line}:
+		case <-ctx.Done():
+			// drain output to let command finish
+			io.Copy(ioutil.Discard, r)
+			return
+		}
+	}
+}
+
+// readLimitedLine read one line (without end of line) from `r`; lines
+// longer than `max` bytes are truncated and rest of line is discarded.
+func readLimitedLine(r *bufio.Reader, max int) (line string, truncated bool, err error) {
+	var buf []byte
+
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			if err == io.EOF && len(buf) > 0 {
+				// last line without new line
+				return string(buf), truncated, nil
+			}
+			return "", false, err
+		}
+
+		if room := max - len(buf); len(chunk) > room {
+			chunk = chunk[:room]
+			truncated = true
+		}
+		buf = append(buf, chunk...)
+
+		if !isPrefix {
+			return string(buf), truncated, nil
+		}
+	}
+}
+
+// Stop wait for command finish; command is terminated when context given
+// in Start is cancelled.
+func (e *ExecReader) Stop() error {
+	e.wg.Wait()
+	return nil
+}
+
+func (e *ExecReader) Read(ctx context.Context) (rec *Record, err error) {
+	select {
+	case l, ok := <-e.lines:
+		if !ok {
+			return nil, io.EOF
+		}
+		return &Record{
+			Message: l.text,
+			Fields:  map[string]string{"STREAM": l.stream},
+			Time:    l.time,
+			Source:  e.c.File,
+		}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
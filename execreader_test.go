@@ -0,0 +1,179 @@
+//
+// execreader_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestExecReader(t *testing.T, command string, options map[string]string) *ExecReader {
+	r, err := (&ExecReader{}).Create(&WorkerConf{File: execPrefix + command, Options: options}, log)
+	if err != nil {
+		t.Fatalf("create reader error: %s", err)
+	}
+	return r.(*ExecReader)
+}
+
+// readAllExec read records until EOF or timeout
+func readAllExec(t *testing.T, r *ExecReader, timeout time.Duration) []*Record {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var recs []*Record
+	for {
+		rec, err := r.Read(ctx)
+		if err == io.EOF {
+			return recs
+		}
+		if err != nil {
+			t.Fatalf("read error (records: %d): %s", len(recs), err)
+		}
+		recs = append(recs, rec)
+	}
+}
+
+func TestExecReaderStreams(t *testing.T) {
+	defer func(v bool) { *runOnce = v }(*runOnce)
+	*runOnce = true
+
+	tests := []struct {
+		stream   string
+		expected []string
+	}{
+		{"", []string{"stdout:out", "stderr:err"}},
+		{"stdout", []string{"stdout:out"}},
+		{"stderr", []string{"stderr:err"}},
+	}
+
+	for _, tc := range tests {
+		r := newTestExecReader(t, "echo out; echo err >&2", map[string]string{"stream": tc.stream})
+		r.Start(context.Background())
+
+		found := make(map[string]bool)
+		for _, rec := range readAllExec(t, r, 5*time.Second) {
+			found[rec.Fields["STREAM"]+":"+rec.Message] = true
+		}
+		r.Stop()
+
+		if len(found) != len(tc.expected) {
+			t.Errorf("stream '%s': expected %v, got %v", tc.stream, tc.expected, found)
+		}
+		for _, e := range tc.expected {
+			if !found[e] {
+				t.Errorf("stream '%s': missing %s in %v", tc.stream, e, found)
+			}
+		}
+	}
+
+	if _, err := (&ExecReader{}).Create(&WorkerConf{File: execPrefix + "true",
+		Options: map[string]string{"stream": "other"}}, log); err == nil {
+		t.Errorf("missing error for invalid stream")
+	}
+}
+
+func TestExecReaderChildKeepOutput(t *testing.T) {
+	defer func(v bool) { *runOnce = v }(*runOnce)
+	*runOnce = true
+
+	// child process keep stderr open after command exit
+	r := newTestExecReader(t, "sleep 3 >&2 & echo done", nil)
+	r.Start(context.Background())
+
+	start := time.Now()
+	recs := readAllExec(t, r, 5*time.Second)
+	r.Stop()
+
+	if len(recs) != 1 || recs[0].Message != "done" {
+		t.Errorf("invalid records: %v", recs)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("reader waited for child process: %s", d)
+	}
+}
+
+func TestExecReaderExitCode(t *testing.T) {
+	r := newTestExecReader(t, "exit 3", nil)
+	r.lines = make(chan execLine, 10)
+
+	err := r.execute(context.Background())
+	if ee, ok := err.(*exec.ExitError); !ok || ee.Success() {
+		t.Errorf("expected exit error, got %v", err)
+	}
+
+	if err := newTestExecReader(t, "true", nil).execute(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestExecReaderRestart(t *testing.T) {
+	defer func(v bool) { *runOnce = v }(*runOnce)
+	*runOnce = false
+
+	r := newTestExecReader(t, "echo line", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	r.Start(ctx)
+
+	// command is restarted after execMinRestartDelay
+	readCtx, readCancel := context.WithTimeout(ctx, execMinRestartDelay*3)
+	defer readCancel()
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		rec, err := r.Read(readCtx)
+		if err != nil {
+			t.Fatalf("read %d error: %s", i, err)
+		}
+		if rec.Message != "line" {
+			t.Errorf("invalid record: %+v", rec)
+		}
+	}
+	if d := time.Since(start); d < execMinRestartDelay {
+		t.Errorf("command restarted without delay: %s", d)
+	}
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		r.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("reader not stopped after cancel")
+	}
+}
+
+func TestReadLimitedLine(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	r := bufio.NewReaderSize(strings.NewReader("a\n"+long+"\nb\r\nlast"), 16)
+
+	exp := []struct {
+		line      string
+		truncated bool
+	}{
+		{"a", false},
+		{long[:30], true},
+		{"b", false},
+		{"last", false},
+	}
+	for _, e := range exp {
+		line, truncated, err := readLimitedLine(r, 30)
+		if err != nil || line != e.line || truncated != e.truncated {
+			t.Errorf("invalid line: %q, %v, %v; expected %q, %v", line, truncated, err, e.line, e.truncated)
+		}
+	}
+	if _, _, err := readLimitedLine(r, 30); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
@@ -0,0 +1,275 @@
+//
+// forward.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Forwarding accepted lines to file, unix socket or tcp endpoint.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	defaultForwardMaxSize  = 10 * 1024 * 1024
+	defaultForwardMaxFiles = 3
+
+	forwardWriteTimeout   = time.Second
+	forwardReconnectDelay = 5 * time.Second
+	// number of lines waiting for write to socket
+	forwardQueueSize = 1000
+)
+
+var forwardLinesCntr = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "logmonitor",
+		Name:      "forward_lines_total",
+		Help:      "Total number lines forwarded by result",
+	},
+	[]string{"target", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(forwardLinesCntr)
+}
+
+// Forwarder write lines to file (with rotation by size) or socket
+type Forwarder struct {
+	conf *ForwardConf
+
+	mu sync.Mutex
+	// network and address for sockets; empty network = file
+	network, address string
+	w                io.WriteCloser
+	// size of current file
+	size int64
+	// lastDial is time of last connection attempt
+	lastDial time.Time
+
+	// queue of lines to write to socket by sendLoop; nil for files
+	queue chan []byte
+	done  chan struct{}
+
+	// number of users (workers and metrics)
+	refs int
+}
+
+// forwarders are shared by all workers and metrics with the same target
+var forwarders struct {
+	mu sync.Mutex
+	f  map[string]*Forwarder
+}
+
+// openForwarder return forwarder for target; forwarder must be released by
+// releaseForwarder
+func openForwarder(conf *ForwardConf) (*Forwarder, error) {
+	forwarders.mu.Lock()
+	defer forwarders.mu.Unlock()
+
+	if f, ok := forwarders.f[conf.Target]; ok {
+		f.refs++
+		return f, nil
+	}
+
+	f := &Forwarder{conf: conf, refs: 1}
+
+	switch {
+	case strings.HasPrefix(conf.Target, "unix:"):
+		f.network, f.address = "unix", strings.TrimPrefix(conf.Target, "unix:")
+	case strings.HasPrefix(conf.Target, "tcp:"):
+		f.network, f.address = "tcp", strings.TrimPrefix(conf.Target, "tcp:")
+	default:
+		if err := f.openFile(); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.network != "" {
+		// slow or unavailable endpoint must not block workers
+		f.queue = make(chan []byte, forwardQueueSize)
+		f.done = make(chan struct{})
+		go f.sendLoop()
+	}
+
+	if forwarders.f == nil {
+		forwarders.f = make(map[string]*Forwarder)
+	}
+	forwarders.f[conf.Target] = f
+
+	return f, nil
+}
+
+// releaseForwarder close forwarder when it is not used anymore
+func releaseForwarder(f *Forwarder) {
+	forwarders.mu.Lock()
+	defer forwarders.mu.Unlock()
+
+	f.refs--
+	if f.refs > 0 {
+		return
+	}
+
+	delete(forwarders.f, f.conf.Target)
+
+	if f.queue != nil {
+		// write queued lines
+		close(f.queue)
+		<-f.done
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.w != nil {
+		f.w.Close()
+		f.w = nil
+	}
+}
+
+func (f *Forwarder) openFile() error {
+	file, err := os.OpenFile(f.conf.Target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open file error")
+	}
+
+	f.size = 0
+	if fi, err := file.Stat(); err == nil {
+		f.size = fi.Size()
+	}
+	f.w = file
+
+	return nil
+}
+
+// rotate file: target -> target.1 -> target.2 ...
+func (f *Forwarder) rotate() error {
+	f.w.Close()
+	f.w = nil
+
+	for i := f.conf.MaxFiles - 1; i > 0; i-- {
+		os.Rename(f.conf.Target+"."+strconv.Itoa(i), f.conf.Target+"."+strconv.Itoa(i+1))
+	}
+	if f.conf.MaxFiles > 0 {
+		os.Rename(f.conf.Target, f.conf.Target+".1")
+	} else {
+		os.Remove(f.conf.Target)
+	}
+
+	return f.openFile()
+}
+
+// connect to socket; connection is not retried more often than
+// forwardReconnectDelay
+func (f *Forwarder) connect() error {
+	if time.Since(f.lastDial) < forwardReconnectDelay {
+		return errors.New("not connected")
+	}
+	f.lastDial = time.Now()
+
+	conn, err := net.DialTimeout(f.network, f.address, forwardWriteTimeout)
+	if err != nil {
+		return errors.Wrap(err, "connect error")
+	}
+	f.w = conn
+	return nil
+}
+
+// Forward write `line`; when `metric` or `labels` are given line is
+// prefixed by metric{label="value",...}
+func (f *Forwarder) Forward(line, metric string, labelNames, labels []string) {
+	var b bytes.Buffer
+	if metric != "" || len(labels) > 0 {
+		b.WriteString(metric)
+		b.WriteByte('{')
+		for i, l := range labelNames {
+			if i >= len(labels) {
+				break
+			}
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, "%s=%q", l, labels[i])
+		}
+		b.WriteString("} ")
+	}
+	b.WriteString(line)
+	b.WriteByte('\n')
+
+	if f.queue == nil {
+		f.observe(f.write(b.Bytes()))
+		return
+	}
+
+	select {
+	case f.queue <- b.Bytes():
+	default:
+		forwardLinesCntr.WithLabelValues(f.conf.Target, "dropped").Inc()
+	}
+}
+
+// sendLoop write lines from queue to socket until queue is closed
+func (f *Forwarder) sendLoop() {
+	defer close(f.done)
+
+	for data := range f.queue {
+		f.observe(f.write(data))
+	}
+}
+
+// observe count result of writing line
+func (f *Forwarder) observe(err error) {
+	if err != nil {
+		log.Debugf("forward to %s error: %s", f.conf.Target, err)
+		forwardLinesCntr.WithLabelValues(f.conf.Target, "failed").Inc()
+		return
+	}
+	forwardLinesCntr.WithLabelValues(f.conf.Target, "sent").Inc()
+}
+
+func (f *Forwarder) write(data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.network == "" {
+		if f.w == nil {
+			return errors.New("file closed")
+		}
+
+		if f.conf.MaxSize > 0 && f.size+int64(len(data)) > f.conf.MaxSize && f.size > 0 {
+			if err := f.rotate(); err != nil {
+				return errors.Wrap(err, "rotate error")
+			}
+		}
+
+		n, err := f.w.Write(data)
+		f.size += int64(n)
+		return err
+	}
+
+	if f.w == nil {
+		if err := f.connect(); err != nil {
+			return err
+		}
+	}
+
+	conn := f.w.(net.Conn)
+	conn.SetWriteDeadline(time.Now().Add(forwardWriteTimeout))
+	if _, err := conn.Write(data); err != nil {
+		// reconnect on next write
+		conn.Close()
+		f.w = nil
+		return err
+	}
+
+	return nil
+}
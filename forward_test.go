@@ -0,0 +1,107 @@
+//
+// forward_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestForwardFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &ForwardConf{Target: filepath.Join(dir, "fwd.log"), MaxSize: 20, MaxFiles: 1}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate error: %s", err)
+	}
+
+	f, err := openForwarder(conf)
+	if err != nil {
+		t.Fatalf("open forwarder error: %s", err)
+	}
+	if f2, _ := openForwarder(conf); f2 != f {
+		t.Errorf("forwarder for the same target should be shared")
+	} else {
+		releaseForwarder(f2)
+	}
+
+	f.Forward("line 1", "", nil, nil)
+	f.Forward("line 2", "", nil, nil)
+	f.Forward("line 3", "m1", []string{"file", "app"}, []string{"f1", "a"})
+	releaseForwarder(f)
+
+	data, _ := ioutil.ReadFile(conf.Target + ".1")
+	if string(data) != "line 1\nline 2\n" {
+		t.Errorf("invalid rotated file content: %q", data)
+	}
+	data, _ = ioutil.ReadFile(conf.Target)
+	if string(data) != "m1{file=\"f1\",app=\"a\"} line 3\n" {
+		t.Errorf("invalid file content: %q", data)
+	}
+}
+
+func TestForwardTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	defer l.Close()
+
+	conf := &ForwardConf{Target: "tcp:" + l.Addr().String()}
+	conf.validate()
+	f, err := openForwarder(conf)
+	if err != nil {
+		t.Fatalf("open forwarder error: %s", err)
+	}
+	defer releaseForwarder(f)
+
+	f.Forward("error line", "", nil, nil)
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept error: %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "error line\n" {
+		t.Errorf("invalid line received: %q, %v", line, err)
+	}
+}
+
+func TestForwardQueueFull(t *testing.T) {
+	conf := &ForwardConf{Target: "tcp:127.0.0.1:1"}
+	// forwarder without sending goroutine
+	f := &Forwarder{conf: conf, network: "tcp", queue: make(chan []byte, 1)}
+
+	dropped := forwardLinesCntr.WithLabelValues(conf.Target, "dropped")
+	start := testutil.ToFloat64(dropped)
+
+	for i := 0; i < 3; i++ {
+		f.Forward("line", "", nil, nil)
+	}
+
+	if v := testutil.ToFloat64(dropped) - start; v != 2 {
+		t.Errorf("invalid number of dropped lines: %v", v)
+	}
+	if len(f.queue) != 1 {
+		t.Errorf("invalid queue length: %d", len(f.queue))
+	}
+}
@@ -13,7 +13,9 @@ package main
 import "C"
 
 import (
+	"context"
 	"github.com/pkg/errors"
+	"io"
 	"io/ioutil"
 	"strings"
 	"time"
@@ -22,15 +24,23 @@ import (
 
 // SDJournalReader watch one file and report matched lines
 type SDJournalReader struct {
-	c       *WorkerConf
-	j       *C.struct_sd_journal
-	cursor  *C.char
-	filter  []string
-	closing bool
+	c      *WorkerConf
+	j      *C.struct_sd_journal
+	cursor *C.char
+	filter []string
+
+	// tail is second handle of journal used for reading time of the newest
+	// entry (for computing lag); may be nil
+	tail      *C.struct_sd_journal
+	tailTime  time.Time
+	tailCheck time.Time
 
 	log logger
 }
 
+// interval between reading time of the newest entry in journal
+const journalTailCheckInterval = time.Second
+
 func init() {
 	MustRegisterReader(&SDJournalReader{})
 }
@@ -53,20 +63,14 @@ func (s *SDJournalReader) Create(conf *WorkerConf, l logger) (Reader, error) {
 }
 
 // Start worker (reading file)
-func (s *SDJournalReader) Start() error {
+func (s *SDJournalReader) Start(ctx context.Context) error {
 	if s.j != nil {
 		return errors.Errorf("already reading")
 	}
 
 	s.j = new(C.struct_sd_journal)
 
-	var fname, args string
-	if sr := strings.IndexRune(s.c.File, '?'); sr > 0 {
-		fname = s.c.File[:sr]
-		args = s.c.File[sr+1:]
-	} else {
-		fname = s.c.File
-	}
+	fname, filter := splitJournalFile(s.c.File)
 
 	var flag C.int = C.SD_JOURNAL_LOCAL_ONLY
 	switch fname {
@@ -86,17 +90,27 @@ func (s *SDJournalReader) Start() error {
 		return errors.Errorf("journal open error: %s", C.GoString(C.strerror(-res)))
 	}
 
+	if res := C.sd_journal_open(&s.tail, flag); res < 0 {
+		s.tail = nil
+		s.log.Warnf("journal open error: %s; lag will not be reported",
+			C.GoString(C.strerror(-res)))
+	}
+
 	if s.c.StampFile == "" || !s.seekLastPos() {
-		// move to end
-		if res := C.sd_journal_seek_tail(s.j); res < 0 {
+		if *runOnce {
+			// in once mode read whole journal
+			if res := C.sd_journal_seek_head(s.j); res < 0 {
+				s.Stop()
+				return errors.Errorf("journal seek head error: %s", C.GoString(C.strerror(-res)))
+			}
+		} else if res := C.sd_journal_seek_tail(s.j); res < 0 {
+			// move to end
 			s.Stop()
 			return errors.Errorf("journal seek tail error: %s", C.GoString(C.strerror(-res)))
 		}
 	}
 
-	if args != "" {
-		s.filter = strings.Split(args, "&")
-	}
+	s.filter = filter
 
 	return nil
 }
@@ -128,35 +142,53 @@ func (s *SDJournalReader) seekLastPos() (success bool) {
 	return true
 }
 
-// Stop worker
+// Stop worker; called when Read is not running anymore
 func (s *SDJournalReader) Stop() error {
+	if s.tail != nil {
+		C.sd_journal_close(s.tail)
+		s.tail = nil
+	}
 	if s.j != nil {
-		s.closing = true
-		time.Sleep(1 * time.Second)
 		C.sd_journal_close(s.j)
 		s.j = nil
-		if s.c.StampFile != "" {
-			ioutil.WriteFile(s.c.StampFile, []byte(C.GoString(s.cursor)), 0644)
+		// don't overwrite position of other instance in once mode
+		if s.c.StampFile != "" && !*runOnce {
+			if err := writeFileAtomic(s.c.StampFile, []byte(C.GoString(s.cursor))); err != nil {
+				s.log.Warnf("save position error: %s", err)
+			}
 		}
 	}
 	return nil
 }
 
-func (s *SDJournalReader) Read() (line string, err error) {
+func (s *SDJournalReader) Read(ctx context.Context) (rec *Record, err error) {
 	var res C.int
 	var data *C.char
 	var length C.size_t
+	var usec C.uint64_t
 
 	for {
-		if s.j == nil || s.closing {
-			return
+		if s.j == nil {
+			return nil, errors.New("journal not opened")
+		}
+
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 
 		if res = C.sd_journal_next(s.j); res < 0 {
 			s.log.Warnf("journal next error: %s", C.GoString(C.strerror(-res)))
-			time.Sleep(time.Duration(1) * time.Second)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
 			continue
 		} else if res == 0 {
+			if *runOnce {
+				// all entries read
+				return nil, io.EOF
+			}
+			ObserveJournalLag(s.c.File, 0)
 			if res = C.sd_journal_wait(s.j, 1000000); res < 0 {
 				s.log.Debugf("failed to wait for changes: %s", C.GoString(C.strerror(-res)))
 			}
@@ -170,31 +202,60 @@ func (s *SDJournalReader) Read() (line string, err error) {
 
 		C.sd_journal_restart_data(s.j)
 
-		// number of arguments to find in record to accept record
-		argsMissing := len(s.filter)
-
+		fields := make(map[string]string)
 		for C.sd_journal_enumerate_data(s.j, (*unsafe.Pointer)(unsafe.Pointer(&data)), &length) > 0 {
-			data := C.GoString(data)
-			//s.log.Debugf("parts: '%v'", data)
-			if len(data) > 8 && data[:8] == "MESSAGE=" {
-				line = data[8:]
-				if argsMissing == 0 {
-					// all arguments found and we can stop here
-					return
-				}
-			} else if argsMissing > 0 {
-				// check if this data is on filter list == is required for accept line
-				for _, f := range s.filter {
-					if f == data {
-						argsMissing--
-					}
-				}
+			data := C.GoStringN(data, C.int(length))
+			if idx := strings.IndexRune(data, '='); idx > 0 {
+				fields[data[:idx]] = data[idx+1:]
 			}
 		}
 
-		if argsMissing == 0 {
-			// record accepted
-			return
+		if !journalEntryAccepted(fields, s.filter) {
+			continue
 		}
+
+		// record accepted
+		rec = &Record{
+			Message: fields["MESSAGE"],
+			Fields:  fields,
+			Source:  s.c.File,
+		}
+
+		if res = C.sd_journal_get_realtime_usec(s.j, &usec); res >= 0 {
+			rec.Time = usecToTime(usec)
+			if newest := s.newestTime(); !newest.IsZero() {
+				ObserveJournalLag(s.c.File, entryLag(newest, rec.Time))
+			}
+		}
+
+		return rec, nil
+	}
+}
+
+// newestTime return time of the newest entry in journal; journal is
+// checked at most once per journalTailCheckInterval.
+func (s *SDJournalReader) newestTime() time.Time {
+	if s.tail == nil {
+		return time.Time{}
 	}
+
+	now := time.Now()
+	if now.Sub(s.tailCheck) < journalTailCheckInterval {
+		return s.tailTime
+	}
+	s.tailCheck = now
+
+	var usec C.uint64_t
+	// process changes (i.e. new journal files) before seeking
+	C.sd_journal_process(s.tail)
+	if C.sd_journal_seek_tail(s.tail) >= 0 && C.sd_journal_previous(s.tail) > 0 &&
+		C.sd_journal_get_realtime_usec(s.tail, &usec) >= 0 {
+		s.tailTime = usecToTime(usec)
+	}
+
+	return s.tailTime
+}
+
+func usecToTime(usec C.uint64_t) time.Time {
+	return time.Unix(int64(usec)/1000000, (int64(usec)%1000000)*1000)
 }
@@ -0,0 +1,394 @@
+//
+// journalexport.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Reader for systemd Journal Export Format
+// (https://www.freedesktop.org/wiki/Software/systemd/export/) read from
+// file or received over http from systemd-journal-upload.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	journalExportPrefix = ":journal_export"
+	journalRemotePrefix = ":journal_remote"
+
+	// journalRemoteDefaultListen is default address used by systemd-journal-remote
+	journalRemoteDefaultListen = ":19532"
+	journalExportContentType   = "application/vnd.fdo.journal"
+
+	// maximal size of binary field accepted from stream
+	journalExportMaxFieldSize = 64 * 1024 * 1024
+)
+
+// errReaderStopped is returned by readStream when reader is stopped before
+// all entries are passed to Read
+var errReaderStopped = errors.New("reader stopped")
+
+// splitJournalFile split `file` definition into name and list of required
+// fields in form FIELD=value (given after "?" and separated by "&").
+func splitJournalFile(file string) (name string, filter []string) {
+	if sr := strings.IndexRune(file, '?'); sr > 0 {
+		name = file[:sr]
+		if args := file[sr+1:]; args != "" {
+			filter = strings.Split(args, "&")
+		}
+		return
+	}
+	return file, nil
+}
+
+// journalEntryAccepted check is entry contains all fields required by filter
+func journalEntryAccepted(fields map[string]string, filter []string) bool {
+	for _, f := range filter {
+		idx := strings.IndexRune(f, '=')
+		if idx < 0 {
+			// only field name; require existence of field
+			if _, ok := fields[f]; !ok {
+				return false
+			}
+			continue
+		}
+		if v, ok := fields[f[:idx]]; !ok || v != f[idx+1:] {
+			return false
+		}
+	}
+	return true
+}
+
+// readJournalExportEntry read one entry from stream in journal export format.
+// Returns io.EOF when stream ends before any field of next entry.
+func readJournalExportEntry(r *bufio.Reader) (fields map[string]string, err error) {
+	fields = make(map[string]string)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" && len(fields) == 0 {
+				return nil, io.EOF
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, errors.Wrap(err, "read entry error")
+		}
+
+		line = line[:len(line)-1]
+		if line == "" {
+			if len(fields) > 0 {
+				return fields, nil
+			}
+			// skip empty lines between entries
+			continue
+		}
+
+		if idx := strings.IndexRune(line, '='); idx >= 0 {
+			fields[line[:idx]] = line[idx+1:]
+			continue
+		}
+
+		// binary field: name, new line, little-endian 64bit size, data, new line
+		var size uint64
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return nil, errors.Wrapf(err, "read size of field '%s' error", line)
+		}
+		if size > journalExportMaxFieldSize {
+			return nil, errors.Errorf("field '%s' too big (%d)", line, size)
+		}
+
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, errors.Wrapf(err, "read field '%s' error", line)
+		}
+		if data[size] != '\n' {
+			return nil, errors.Errorf("missing new line after field '%s'", line)
+		}
+		fields[line] = string(data[:size])
+	}
+}
+
+// followReader read file and wait for new data on eof until `quit` is closed
+type followReader struct {
+	f    *os.File
+	quit <-chan struct{}
+}
+
+func (f *followReader) Read(p []byte) (n int, err error) {
+	for {
+		n, err = f.f.Read(p)
+		if n > 0 || err != io.EOF {
+			return
+		}
+
+		select {
+		case <-f.quit:
+			return 0, io.EOF
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// JournalExportReader read entries in journal export format from file
+// (:journal_export/<path>) or from http requests send by
+// systemd-journal-upload (:journal_remote).
+type JournalExportReader struct {
+	c      *WorkerConf
+	filter []string
+	remote bool
+	path   string
+
+	entries chan map[string]string
+	// quit is closed when reading should stop (done channel of context)
+	quit   <-chan struct{}
+	wg     sync.WaitGroup
+	server *http.Server
+	file   *os.File
+
+	// newest is time of the newest entry received (for computing lag)
+	mu     sync.Mutex
+	newest time.Time
+
+	log logger
+}
+
+func init() {
+	MustRegisterReader(&JournalExportReader{})
+}
+
+// Match reader to configuration file.
+func (j *JournalExportReader) Match(conf *WorkerConf) (prio int) {
+	if strings.HasPrefix(conf.File, journalExportPrefix) ||
+		strings.HasPrefix(conf.File, journalRemotePrefix) {
+		return 99
+	}
+	return -1
+}
+
+// Create new reader for journal export format
+func (j *JournalExportReader) Create(conf *WorkerConf, l logger) (Reader, error) {
+	l.Infof("Monitoring '%s' by Journal Export Reader", conf.File)
+
+	name, filter := splitJournalFile(conf.File)
+	r := &JournalExportReader{
+		c:      conf,
+		filter: filter,
+		log:    l,
+	}
+
+	switch {
+	case name == journalRemotePrefix:
+		r.remote = true
+	case strings.HasPrefix(name, journalExportPrefix+"/"):
+		r.path = name[len(journalExportPrefix):]
+	default:
+		return nil, errors.Errorf("invalid journal export definition: '%s'", conf.File)
+	}
+
+	return r, nil
+}
+
+// Start reading file or start listen for requests
+func (j *JournalExportReader) Start(ctx context.Context) error {
+	if j.quit != nil {
+		return errors.Errorf("already reading")
+	}
+
+	j.entries = make(chan map[string]string, 100)
+	j.quit = ctx.Done()
+
+	if j.remote {
+		return j.startServer()
+	}
+
+	return j.startFile()
+}
+
+func (j *JournalExportReader) startFile() (err error) {
+	if j.file, err = os.Open(j.path); err != nil {
+		return errors.Wrap(err, "open file error")
+	}
+
+	var r io.Reader = j.file
+	if j.c.Options["follow"] != "no" && !*runOnce {
+		r = &followReader{f: j.file, quit: j.quit}
+	}
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		// only this goroutine send entries in file mode
+		defer close(j.entries)
+		err := j.readStream(bufio.NewReader(r))
+		if err != nil && err != io.EOF && err != errReaderStopped {
+			j.log.Errorf("read journal export file error: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+func (j *JournalExportReader) startServer() (err error) {
+	listen := j.c.Options["listen"]
+	if listen == "" {
+		listen = journalRemoteDefaultListen
+	}
+
+	// optional TLS and basic authentication; the same format as
+	// -web.config.file
+	var wc *WebConfig
+	if path := j.c.Options["web_config"]; path != "" {
+		if wc, err = LoadWebConfig(path); err != nil {
+			return errors.Wrap(err, "load web config error")
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", j.handleUpload)
+	if j.server, err = newWebServer(listen, wc, withBasicAuth(wc, mux)); err != nil {
+		return errors.Wrap(err, "create server error")
+	}
+
+	// bind before start, so errors are reported by Start
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		j.server = nil
+		return errors.Wrap(err, "listen error")
+	}
+
+	server := j.server
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		j.log.Infof("journal remote listening on %s (tls: %v)", listen, server.TLSConfig != nil)
+		if err := serve(server, ln); err != nil && err != http.ErrServerClosed {
+			j.log.Errorf("journal remote listen error: %s", err)
+		}
+	}()
+
+	return nil
+}
+
+// handleUpload accept entries send by systemd-journal-upload
+func (j *JournalExportReader) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Unsupported method.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if ct := r.Header.Get("Content-Type"); ct != journalExportContentType {
+		http.Error(w, "Content-Type: "+journalExportContentType+" is required.",
+			http.StatusUnsupportedMediaType)
+		return
+	}
+
+	err := j.readStream(bufio.NewReader(r.Body))
+	if err == errReaderStopped {
+		// let uploader send entries again
+		http.Error(w, "Service is stopping.", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil && err != io.EOF {
+		j.log.Infof("read upload from %s error: %s", r.RemoteAddr, err)
+		http.Error(w, "Failed to process data.", http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, "OK.\n")
+}
+
+// readStream parse entries from `r` and pass them to Read
+func (j *JournalExportReader) readStream(r *bufio.Reader) error {
+	for {
+		fields, err := readJournalExportEntry(r)
+		if err != nil {
+			return err
+		}
+
+		if t := journalRecordTime(fields); !t.IsZero() {
+			j.mu.Lock()
+			if t.After(j.newest) {
+				j.newest = t
+			}
+			j.mu.Unlock()
+		}
+
+		select {
+		case j.entries <- fields:
+		case <-j.quit:
+			return errReaderStopped
+		}
+	}
+}
+
+// Stop close server and file; reading is stopped by cancelling context
+// given in Start.
+func (j *JournalExportReader) Stop() error {
+	if j.server != nil {
+		j.server.Close()
+		j.server = nil
+	}
+	j.wg.Wait()
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+
+	return nil
+}
+
+func (j *JournalExportReader) Read(ctx context.Context) (rec *Record, err error) {
+	for {
+		if len(j.entries) == 0 {
+			// all received entries processed
+			ObserveJournalLag(j.c.File, 0)
+		}
+
+		select {
+		case fields, ok := <-j.entries:
+			if !ok {
+				return nil, io.EOF
+			}
+			if journalEntryAccepted(fields, j.filter) {
+				rec = &Record{
+					Message: fields["MESSAGE"],
+					Fields:  fields,
+					Time:    journalRecordTime(fields),
+					Source:  j.c.File,
+				}
+				if !rec.Time.IsZero() {
+					j.mu.Lock()
+					newest := j.newest
+					j.mu.Unlock()
+					ObserveJournalLag(j.c.File, entryLag(newest, rec.Time))
+				}
+				return rec, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// entryLag return difference between time of the newest entry and time of
+// current entry
+func entryLag(newest, current time.Time) time.Duration {
+	if lag := newest.Sub(current); lag > 0 {
+		return lag
+	}
+	return 0
+}
@@ -0,0 +1,281 @@
+//
+// journalexport_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func buildJournalExport() []byte {
+	var b bytes.Buffer
+	b.WriteString("__CURSOR=s=1\n")
+	b.WriteString("_HOSTNAME=host1\n")
+	b.WriteString("SYSLOG_IDENTIFIER=sudo\n")
+	b.WriteString("MESSAGE=first message\n")
+	b.WriteString("\n")
+
+	b.WriteString("_HOSTNAME=host2\n")
+	b.WriteString("MESSAGE\n")
+	msg := "multi\nline message"
+	binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+	b.WriteString(msg)
+	b.WriteString("\n")
+	b.WriteString("\n")
+	return b.Bytes()
+}
+
+func TestReadJournalExportEntry(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader(buildJournalExport()))
+
+	e, err := readJournalExportEntry(r)
+	if err != nil {
+		t.Fatalf("read first entry error: %s", err)
+	}
+	if e["MESSAGE"] != "first message" || e["_HOSTNAME"] != "host1" {
+		t.Errorf("invalid first entry: %+v", e)
+	}
+
+	e, err = readJournalExportEntry(r)
+	if err != nil {
+		t.Fatalf("read second entry error: %s", err)
+	}
+	if e["MESSAGE"] != "multi\nline message" || e["_HOSTNAME"] != "host2" {
+		t.Errorf("invalid second entry: %+v", e)
+	}
+
+	if _, err = readJournalExportEntry(r); err != io.EOF {
+		t.Errorf("expected eof, got: %v", err)
+	}
+
+	// truncated binary field
+	data := buildJournalExport()
+	r = bufio.NewReader(bytes.NewReader(data[:len(data)-8]))
+	readJournalExportEntry(r)
+	if _, err = readJournalExportEntry(r); err == nil {
+		t.Errorf("missing error for truncated entry")
+	}
+}
+
+func TestJournalEntryAccepted(t *testing.T) {
+	fields := map[string]string{
+		"MESSAGE":           "msg",
+		"SYSLOG_IDENTIFIER": "sudo",
+		"_COMM":             "sudo",
+	}
+
+	name, filter := splitJournalFile(":journal_remote?SYSLOG_IDENTIFIER=sudo&_COMM=sudo")
+	if name != ":journal_remote" || len(filter) != 2 {
+		t.Fatalf("invalid split result: %v %v", name, filter)
+	}
+	if !journalEntryAccepted(fields, filter) {
+		t.Errorf("entry should be accepted by %v", filter)
+	}
+	if journalEntryAccepted(fields, []string{"_COMM=bash"}) {
+		t.Errorf("entry should not be accepted")
+	}
+	if journalEntryAccepted(fields, []string{"_PID"}) {
+		t.Errorf("entry without field should not be accepted")
+	}
+	if !journalEntryAccepted(fields, nil) {
+		t.Errorf("entry should be accepted by empty filter")
+	}
+}
+
+func TestJournalRemoteUpload(t *testing.T) {
+	conf := &WorkerConf{File: journalRemotePrefix + "?_HOSTNAME=host2"}
+	rd, err := (&JournalExportReader{}).Create(conf, log)
+	if err != nil {
+		t.Fatalf("create reader error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	j := rd.(*JournalExportReader)
+	j.entries = make(chan map[string]string, 10)
+	j.quit = ctx.Done()
+
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(buildJournalExport()))
+	req.Header.Set("Content-Type", journalExportContentType)
+	w := httptest.NewRecorder()
+	j.handleUpload(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("invalid response code: %d", w.Code)
+	}
+
+	rec, err := j.Read(ctx)
+	if err != nil || rec.Message != "multi\nline message" || rec.Fields["_HOSTNAME"] != "host2" {
+		t.Errorf("invalid record read: %+v, %v", rec, err)
+	}
+
+	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(buildJournalExport()))
+	w = httptest.NewRecorder()
+	j.handleUpload(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("invalid response code for missing content type: %d", w.Code)
+	}
+}
+
+func TestJournalExportLag(t *testing.T) {
+	conf := &WorkerConf{File: journalRemotePrefix}
+	rd, err := (&JournalExportReader{}).Create(conf, log)
+	if err != nil {
+		t.Fatalf("create reader error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	j := rd.(*JournalExportReader)
+	j.entries = make(chan map[string]string, 10)
+	j.quit = ctx.Done()
+
+	// entries 10s and 4s before the newest one
+	data := "__REALTIME_TIMESTAMP=1500000000000000\nMESSAGE=m1\n\n" +
+		"__REALTIME_TIMESTAMP=1500000006000000\nMESSAGE=m2\n\n" +
+		"__REALTIME_TIMESTAMP=1500000010000000\nMESSAGE=m3\n\n"
+	if err := j.readStream(bufio.NewReader(bytes.NewReader([]byte(data)))); err != io.EOF {
+		t.Fatalf("read stream error: %v", err)
+	}
+
+	for _, exp := range []float64{10, 4, 0} {
+		if _, err := j.Read(ctx); err != nil {
+			t.Fatalf("read error: %s", err)
+		}
+		if v := testutil.ToFloat64(journalLag.WithLabelValues(conf.File)); v != exp {
+			t.Errorf("invalid lag: %v, expected %v", v, exp)
+		}
+	}
+}
+
+func TestJournalRemoteBasicAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	wcFile := filepath.Join(dir, "web.yml")
+	if err := ioutil.WriteFile(wcFile, []byte("basic_auth_users:\n  user: "+string(hash)+"\n"), 0600); err != nil {
+		t.Fatalf("write web config error: %s", err)
+	}
+
+	// find free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	conf := &WorkerConf{
+		File:    journalRemotePrefix,
+		Options: map[string]string{"listen": addr, "web_config": wcFile},
+	}
+	rd, err := (&JournalExportReader{}).Create(conf, log)
+	if err != nil {
+		t.Fatalf("create reader error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := rd.Start(ctx); err != nil {
+		t.Fatalf("start reader error: %s", err)
+	}
+	defer rd.Stop()
+
+	tests := []struct {
+		user, pass string
+		code       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"user", "bad", http.StatusUnauthorized},
+		{"user", "secret", http.StatusAccepted},
+	}
+
+	for _, tc := range tests {
+		req, _ := http.NewRequest("POST", "http://"+addr+"/upload", bytes.NewReader(buildJournalExport()))
+		req.Header.Set("Content-Type", journalExportContentType)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		var resp *http.Response
+		// wait for server start
+		for i := 0; i < 50; i++ {
+			if resp, err = http.DefaultClient.Do(req); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+			req.Body = ioutil.NopCloser(bytes.NewReader(buildJournalExport()))
+		}
+		if err != nil {
+			t.Fatalf("request error: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("%s/%s: invalid response code %d, expected %d", tc.user, tc.pass, resp.StatusCode, tc.code)
+		}
+	}
+}
+
+func TestJournalRemoteStopped(t *testing.T) {
+	conf := &WorkerConf{File: journalRemotePrefix}
+	rd, err := (&JournalExportReader{}).Create(conf, log)
+	if err != nil {
+		t.Fatalf("create reader error: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// entries are not read after stop
+	j := rd.(*JournalExportReader)
+	j.entries = make(chan map[string]string)
+	j.quit = ctx.Done()
+
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(buildJournalExport()))
+	req.Header.Set("Content-Type", journalExportContentType)
+	w := httptest.NewRecorder()
+	j.handleUpload(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("invalid response code: %d", w.Code)
+	}
+}
+
+func TestJournalRemoteListenError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	defer l.Close()
+
+	conf := &WorkerConf{
+		File:    journalRemotePrefix,
+		Options: map[string]string{"listen": l.Addr().String()},
+	}
+	rd, err := (&JournalExportReader{}).Create(conf, log)
+	if err != nil {
+		t.Fatalf("create reader error: %s", err)
+	}
+	if err := rd.Start(context.Background()); err == nil {
+		rd.Stop()
+		t.Errorf("expected error for address in use")
+	}
+}
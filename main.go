@@ -4,13 +4,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/Merovius/systemd"
 	"github.com/prometheus/client_golang/prometheus"
@@ -22,11 +23,33 @@ var (
 	showVersion = flag.Bool("version", false, "Print version information.")
 	configFile  = flag.String("config.file", "logmonitor.yml",
 		"Path to configuration file.")
+	configDir = flag.String("config.dir", "",
+		"Directory with additional configuration files (*.yml, *.yaml).")
+	configDump = flag.Bool("config.dump", false,
+		"Print configuration after loading and resolving templates and exit.")
+	configStrict = flag.Bool("config.strict", false,
+		"Treat unknown fields in configuration as errors.")
+	configSchema = flag.Bool("config.schema", false,
+		"Print JSON Schema of configuration file and exit.")
+	configWatch = flag.Bool("config.watch", false,
+		"Reload configuration when configuration files change.")
 	listenAddress = flag.String("web.listen-address", ":9704",
-		"Address to listen on for web interface and telemetry.")
+		"Address to listen on for web interface and telemetry; empty - disable.")
+	webConfigFile = flag.String("web.config.file", "",
+		"Path to configuration file that can enable TLS or authentication.")
+	enablePprof = flag.Bool("web.enable-pprof", false,
+		"Enable profiling endpoints under /debug/pprof/.")
 	loglevel = flag.String("log.level", "info",
 		"Logging level (debug, info, warn, error, fatal)")
 	logFile = flag.String("log.file", "", "Write log to given file")
+	runOnce = flag.Bool("once", false,
+		"Read inputs to end, write metrics and exit.")
+	onceOutput = flag.String("once.output", "-",
+		"Where write metrics in once mode (file name or - for stdout).")
+	shutdownTimeout = flag.Duration("shutdown.timeout", 10*time.Second,
+		"Maximal time to wait for workers stop.")
+	patternStats = flag.Bool("metrics.pattern-stats", false,
+		"Expose number of matches and matching time for each pattern.")
 )
 
 var (
@@ -38,11 +61,27 @@ var (
 		},
 		[]string{"metric", "status"},
 	)
+	configReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "logmonitor",
+			Name:      "config_last_reload_successful",
+			Help:      "Whether the last configuration reload attempt was successful",
+		},
+	)
+	configReloadSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "logmonitor",
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("logmonitor"))
 	prometheus.MustRegister(workersStatus)
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadSeconds)
 }
 
 func main() {
@@ -53,6 +92,16 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *configSchema {
+		b, err := json.MarshalIndent(configurationSchema(), "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating schema: %s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stdout, string(b))
+		os.Exit(0)
+	}
+
 	InitializeLogger(*loglevel, *logFile)
 
 	systemd.NotifyStatus("starting")
@@ -61,71 +110,214 @@ func main() {
 	log.Infoln("Starting logmonitor", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
-	c, err := LoadConfiguration(*configFile)
+	loadOpts := LoadOptions{Dir: *configDir, Strict: *configStrict}
+	c, err := LoadConfiguration(*configFile, loadOpts)
 	if err != nil {
 		log.Fatalf("Error parsing config file: %s", err)
 		return
 	}
 
+	var webConfig *WebConfig
+	if *webConfigFile != "" {
+		if webConfig, err = LoadWebConfig(*webConfigFile); err != nil {
+			log.Fatalf("Error parsing web config file: %s", err)
+			return
+		}
+	}
+
+	if *configDump {
+		b, err := DumpConfiguration(*configFile, loadOpts)
+		if err != nil {
+			log.Fatalf("Error dumping configuration: %s", err)
+		}
+		os.Stdout.Write(b)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *runOnce {
+		if err := runOnceMode(ctx, c); err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		return
+	}
+
 	initMetrics(c)
+	configReloadSuccess.Set(1)
+	configReloadSeconds.SetToCurrentTime()
 
-	http.Handle("/metrics", promhttp.Handler())
+	monitors := createWorkers(ctx, c)
+	pusher := startPusher(c)
+	remoteWriter := startRemoteWriter(c)
+	textfileWriter := startTextfileWriter(c, prometheus.DefaultGatherer)
 
-	monitors := createWorkers(c)
+	if *listenAddress != "" {
+		handler := newWebHandler(webConfig, promhttp.Handler(), *enablePprof)
+		go func() {
+			log.Fatal(serveWeb(*listenAddress, webConfig, handler))
+		}()
+	}
+
+	systemd.NotifyReady()
+	systemd.NotifyStatus("running")
 
 	// handle hup for reloading configuration
-	hup := make(chan os.Signal)
+	hup := make(chan os.Signal, 1)
 	signal.Notify(hup, syscall.SIGHUP)
-	go func() {
-		for {
-			<-hup
-			systemd.NotifyStatus("reloading")
-			if newConf, err := LoadConfiguration(*configFile); err == nil {
-				log.Debugf("new configuration: %+v", newConf)
-				c = newConf
-
-				for _, m := range monitors {
-					m.Stop()
-				}
-				initMetrics(c)
-				monitors = createWorkers(c)
-
-				log.Info("configuration reloaded")
-			} else {
-				log.Errorf("reloading configuration err: %s", err)
-				log.Errorf("using old configuration")
+
+	// watch configuration files; nil channel when watching is disabled
+	var configChanged <-chan struct{}
+	var watcher *ConfigWatcher
+	if *configWatch {
+		if watcher, err = NewConfigWatcher(defaultConfigWatchDelay); err != nil {
+			log.Errorf("watching configuration error: %s", err)
+		} else {
+			if err = watcher.Watch(*configFile, c, *configDir); err != nil {
+				log.Errorf("watching configuration error: %s", err)
+			}
+			configChanged = watcher.C
+		}
+	}
+
+	// reload configuration; on error old configuration is kept
+	reload := func() {
+		systemd.NotifyStatus("reloading")
+		if newConf, err := LoadConfiguration(*configFile, loadOpts); err == nil {
+			log.Debugf("new configuration loaded; workers: %d", len(newConf.Workers))
+			c = newConf
+
+			if pending := stopWorkers(monitors, *shutdownTimeout); len(pending) > 0 {
+				// new workers can't be started before old ones finish (both
+				// would write the same stamp files) and metrics and outputs
+				// can't be replaced when old workers are running
+				waitWorkers(pending, *shutdownTimeout)
 			}
+			pusher.Stop()
+			remoteWriter.Stop()
+			textfileWriter.Stop()
+			initMetrics(c)
+			monitors = createWorkers(ctx, c)
+			pusher = startPusher(c)
+			remoteWriter = startRemoteWriter(c)
+			textfileWriter = startTextfileWriter(c, prometheus.DefaultGatherer)
+
+			configReloadSuccess.Set(1)
+			configReloadSeconds.SetToCurrentTime()
+			log.Info("configuration reloaded")
+		} else {
+			configReloadSuccess.Set(0)
+			log.Errorf("reloading configuration err: %s", err)
+			log.Errorf("using old configuration")
 		}
-	}()
+
+		if watcher != nil {
+			// included files may be changed
+			if err := watcher.Watch(*configFile, c, *configDir); err != nil {
+				log.Errorf("watching configuration error: %s", err)
+			}
+		}
+		systemd.NotifyStatus("running")
+	}
 
 	// cleanup
 	cleanChannel := make(chan os.Signal, 1)
 	signal.Notify(cleanChannel, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-cleanChannel
-		log.Info("Closing...")
-		systemd.Notify("STOPPING=1\r\nSTATUS=stopping")
-		for _, m := range monitors {
-			m.Stop()
+
+	for {
+		select {
+		case <-hup:
+			reload()
+
+		case <-configChanged:
+			log.Info("configuration files changed")
+			reload()
+
+		case <-cleanChannel:
+			log.Info("Closing...")
+			systemd.Notify("STOPPING=1\r\nSTATUS=stopping")
+			cancel()
+			watcher.Stop()
+			pending := stopWorkers(monitors, *shutdownTimeout)
+			pusher.Stop()
+			remoteWriter.Stop()
+			textfileWriter.Stop()
+			closeSinks(pending)
+			systemd.NotifyStatus("stopped")
+			return
+		}
+	}
+}
+
+// stopWorkers stop all workers and wait for finish up to `timeout`.
+// Returns workers that are not stopped yet.
+func stopWorkers(monitors []*Worker, timeout time.Duration) (pending []*Worker) {
+	for _, m := range monitors {
+		go m.Stop()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	expired := false
+	for _, m := range monitors {
+		if !expired {
+			select {
+			case <-m.Stopped():
+				setWorkerStatus(m.Filename(), statusStopped)
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+
+		select {
+		case <-m.Stopped():
 			setWorkerStatus(m.Filename(), statusStopped)
+		default:
+			log.Warnf("worker for %s not stopped", m.Filename())
+			pending = append(pending, m)
 		}
-		systemd.NotifyStatus("stopped")
-		os.Exit(0)
-	}()
+	}
 
-	go func() {
-		log.Infof("Listening on %s", *listenAddress)
-		log.Fatal(http.ListenAndServe(*listenAddress, nil))
-	}()
+	if len(pending) > 0 {
+		log.Errorf("timeout while waiting for workers stop; %d workers not stopped",
+			len(pending))
+	} else {
+		log.Debug("all workers stopped")
+	}
 
-	systemd.NotifyReady()
-	systemd.NotifyStatus("running")
+	return
+}
+
+// waitWorkers wait until all `monitors` stop; log workers not stopped
+// every `interval`
+func waitWorkers(monitors []*Worker, interval time.Duration) {
+	for _, m := range monitors {
+		for stopped := false; !stopped; {
+			select {
+			case <-m.Stopped():
+				setWorkerStatus(m.Filename(), statusStopped)
+				stopped = true
+			case <-time.After(interval):
+				log.Warnf("still waiting for stop worker for %s", m.Filename())
+			}
+		}
+	}
+}
 
-	done := make(chan bool)
-	<-done
+// closeSinks close outputs when all workers are stopped; outputs can't be
+// closed when some workers (`pending`) are still running.
+func closeSinks(pending []*Worker) {
+	if len(pending) > 0 {
+		log.Warn("outputs not closed; some workers are still running")
+		return
+	}
+	metricsCollection.SetSinks(nil)
 }
 
-func createWorkers(c *Configuration) (monitors []*Worker) {
+func createWorkers(ctx context.Context, c *Configuration) (monitors []*Worker) {
 	for _, l := range c.Workers {
 		setWorkerStatus(l.File, statusStopped)
 		if l.Disabled {
@@ -140,7 +332,7 @@ func createWorkers(c *Configuration) (monitors []*Worker) {
 		}
 
 		monitors = append(monitors, m)
-		if err := m.Start(); err != nil {
+		if err := m.Start(ctx); err != nil {
 			setWorkerStatus(l.File, statusError)
 			log.Errorf("Start monitor %s error: %s", l.File, err)
 		} else {
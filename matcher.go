@@ -0,0 +1,244 @@
+//
+// matcher.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Prefiltering lines by literals required by include patterns. All literals
+// of worker patterns are searched in one pass (Aho-Corasick) and regular
+// expressions are run only when one of its literals was found.
+
+package main
+
+import (
+	"regexp/syntax"
+	"unicode/utf8"
+)
+
+// requiredLiterals return list of literals that one of must exist in text
+// matched by regexp `re`. Returns nil when such list can't be determined.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 || len(re.Rune) == 0 {
+			return nil
+		}
+		for _, r := range re.Rune {
+			// invalid bytes in text are matched as RuneError
+			if r == utf8.RuneError {
+				return nil
+			}
+		}
+		return []string{string(re.Rune)}
+
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return requiredLiterals(re.Sub[0])
+		}
+
+	case syntax.OpConcat:
+		var best []string
+		for _, sub := range re.Sub {
+			if lits := requiredLiterals(sub); betterLiterals(lits, best) {
+				best = lits
+			}
+		}
+		return best
+
+	case syntax.OpAlternate:
+		var res []string
+		for _, sub := range re.Sub {
+			lits := requiredLiterals(sub)
+			if lits == nil {
+				return nil
+			}
+			res = append(res, lits...)
+		}
+		return res
+	}
+
+	return nil
+}
+
+// betterLiterals check if `a` is more selective than `b`: the shortest
+// literal is longer, or on tie there are less alternatives.
+func betterLiterals(a, b []string) bool {
+	if a == nil {
+		return false
+	}
+	if b == nil {
+		return true
+	}
+
+	minA, minB := minLen(a), minLen(b)
+	if minA != minB {
+		return minA > minB
+	}
+	return len(a) < len(b)
+}
+
+func minLen(s []string) int {
+	m := -1
+	for _, v := range s {
+		if m < 0 || len(v) < m {
+			m = len(v)
+		}
+	}
+	return m
+}
+
+// patternLiterals parse `pattern` and find literals required by it
+func patternLiterals(pattern string) []string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	return requiredLiterals(re.Simplify())
+}
+
+// ahoCorasick is automaton that find all occurrences of many patterns in
+// one pass over text.
+type ahoCorasick struct {
+	// next is full transition table (DFA)
+	next [][256]int32
+	// out is list of patterns found when automaton reach state
+	out [][]int
+	// number of patterns
+	patterns int
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	a := &ahoCorasick{patterns: len(patterns)}
+	a.addState()
+
+	// build trie
+	for id, p := range patterns {
+		state := int32(0)
+		for i := 0; i < len(p); i++ {
+			c := p[i]
+			if a.next[state][c] < 0 {
+				a.next[state][c] = a.addState()
+			}
+			state = a.next[state][c]
+		}
+		a.out[state] = append(a.out[state], id)
+	}
+
+	// compute failure links and fill missing transitions (bfs)
+	fail := make([]int32, len(a.next))
+	var queue []int32
+
+	for c := 0; c < 256; c++ {
+		if s := a.next[0][c]; s < 0 {
+			a.next[0][c] = 0
+		} else {
+			queue = append(queue, s)
+		}
+	}
+
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+
+		for c := 0; c < 256; c++ {
+			s := a.next[state][c]
+			if s < 0 {
+				a.next[state][c] = a.next[fail[state]][c]
+				continue
+			}
+
+			fail[s] = a.next[fail[state]][c]
+			a.out[s] = append(a.out[s], a.out[fail[s]]...)
+			queue = append(queue, s)
+		}
+	}
+
+	return a
+}
+
+func (a *ahoCorasick) addState() int32 {
+	var row [256]int32
+	for i := range row {
+		row[i] = -1
+	}
+	a.next = append(a.next, row)
+	a.out = append(a.out, nil)
+	return int32(len(a.next) - 1)
+}
+
+// scan text and return flags for found patterns
+func (a *ahoCorasick) scan(text string) []bool {
+	found := make([]bool, a.patterns)
+
+	state := int32(0)
+	for i := 0; i < len(text); i++ {
+		state = a.next[state][text[i]]
+		for _, id := range a.out[state] {
+			found[id] = true
+		}
+	}
+
+	return found
+}
+
+// literalSet is result of scanning line by prefilter; nil mean "unknown"
+type literalSet []bool
+
+// any check if any of literals `ids` was found
+func (l literalSet) any(ids []int) bool {
+	for _, id := range ids {
+		if l[id] {
+			return true
+		}
+	}
+	return false
+}
+
+// prefilter search literals required by include patterns of all metrics
+type prefilter struct {
+	ac *ahoCorasick
+}
+
+// buildPrefilter collect literals from include patterns applied to message
+// and assign ids of literals to filters. Returns nil when there is no
+// literals.
+func buildPrefilter(metrics []*metricFilters) *prefilter {
+	ids := make(map[string]int)
+	var literals []string
+
+	for _, mf := range metrics {
+		for _, f := range mf.filters {
+			if !f.onMessage() {
+				continue
+			}
+
+			f.includeLits = make([][]int, len(f.includes))
+			for i, r := range f.includes {
+				for _, lit := range patternLiterals(r.String()) {
+					id, ok := ids[lit]
+					if !ok {
+						id = len(literals)
+						ids[lit] = id
+						literals = append(literals, lit)
+					}
+					f.includeLits[i] = append(f.includeLits[i], id)
+				}
+			}
+		}
+	}
+
+	if len(literals) == 0 {
+		return nil
+	}
+
+	return &prefilter{ac: newAhoCorasick(literals)}
+}
+
+// scan line and return found literals
+func (p *prefilter) scan(line string) literalSet {
+	if p == nil {
+		return nil
+	}
+	return literalSet(p.ac.scan(line))
+}
@@ -0,0 +1,131 @@
+//
+// matcher_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPatternLiterals(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		literals []string
+	}{
+		{"error", []string{"error"}},
+		{`systemd\[\d+\]: started`, []string{"]: started"}},
+		{"^(foo|bar)baz$", []string{"baz"}},
+		{"(connection|session) (opened|closed)", []string{"connection", "session"}},
+		{"(?i)error", nil},
+		{".*", nil},
+		{"a?b*", nil},
+		{"(abc)+x", []string{"abc"}},
+		{"(abc){0,2}", nil},
+	}
+
+	for _, tc := range tests {
+		lits := patternLiterals(tc.pattern)
+		sort.Strings(lits)
+		if !reflect.DeepEqual(lits, tc.literals) {
+			t.Errorf("invalid literals for '%s': %v, expected %v", tc.pattern, lits, tc.literals)
+		}
+	}
+}
+
+func TestAhoCorasick(t *testing.T) {
+	ac := newAhoCorasick([]string{"he", "she", "his", "hers", "x"})
+	found := ac.scan("ushers")
+	expected := []bool{true, true, false, true, false}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("invalid scan result: %v", found)
+	}
+}
+
+var benchLines = []string{
+	"Oct 18 10:00:01 host sshd[123]: Accepted publickey for root from 10.0.0.1",
+	"Oct 18 10:00:02 host systemd[1]: Started Session 12 of user root.",
+	"Oct 18 10:00:03 host kernel: [12345.678] eth0: link up",
+	"Oct 18 10:00:04 host sudo: pam_unix(sudo:session): session opened for user root",
+	"Oct 18 10:00:05 host CRON[999]: (root) CMD (run-parts /etc/cron.hourly)",
+	"Oct 18 10:00:06 host nginx: 10.0.0.2 - - GET /index.html 200 1234",
+}
+
+func benchWorker(tb testing.TB, n int) *Worker {
+	w := &Worker{}
+	for i := 0; i < n; i++ {
+		fs, err := BuildFilters([]*Filter{
+			&Filter{
+				Include: []string{fmt.Sprintf(`service%d\[\d+\]: (error|failed)`, i)},
+			},
+			&Filter{
+				Include: []string{fmt.Sprintf(`user%d from \d+\.\d+`, i)},
+				Exclude: []string{"root"},
+			},
+		})
+		if err != nil {
+			tb.Fatalf("build filters error: %s", err)
+		}
+		w.metrics = append(w.metrics, &metricFilters{filters: fs})
+	}
+	fs, _ := BuildFilters([]*Filter{
+		&Filter{Include: []string{`session (opened|closed)`}},
+		&Filter{Include: []string{`(?i)LINK UP`}},
+	})
+	w.metrics = append(w.metrics, &metricFilters{filters: fs})
+	w.prefilter = buildPrefilter(w.metrics)
+	return w
+}
+
+func TestPrefilterSameResults(t *testing.T) {
+	w := benchWorker(t, 20)
+	lines := append([]string{
+		"service7[12]: failed to start",
+		"login user13 from 10.2",
+		"login user13 from 10.2 root",
+	}, benchLines...)
+
+	for _, line := range lines {
+		rec := NewRecord(line, "")
+		found := w.prefilter.scan(line)
+		for i, mf := range w.metrics {
+			if a, b := mf.AcceptRecord(rec), mf.acceptRecord(rec, found); a != b {
+				t.Errorf("different result for metric %d and line '%s': %v, %v", i, line, a, b)
+			}
+		}
+	}
+}
+
+func benchmarkMatch(b *testing.B, prefilter bool) {
+	w := benchWorker(b, 50)
+	recs := make([]*Record, len(benchLines))
+	for i, l := range benchLines {
+		recs[i] = NewRecord(l, "")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := recs[i%len(recs)]
+		var found literalSet
+		if prefilter {
+			found = w.prefilter.scan(rec.Message)
+		}
+		for _, mf := range w.metrics {
+			mf.acceptRecord(rec, found)
+		}
+	}
+}
+
+func BenchmarkMatchRegexp(b *testing.B) {
+	benchmarkMatch(b, false)
+}
+
+func BenchmarkMatchPrefilter(b *testing.B) {
+	benchmarkMatch(b, true)
+}
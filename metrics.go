@@ -7,11 +7,17 @@
 package main
 
 import (
+	"regexp"
+	"strconv"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
-	"sort"
 )
 
 type metricsGroup struct {
+	// names of labels
+	labels []string
+
 	lineMatchedCntr *prometheus.CounterVec
 	lineLastMatch   *prometheus.GaugeVec
 	valuesExtracted *prometheus.GaugeVec
@@ -19,6 +25,7 @@ type metricsGroup struct {
 
 func newMetricsGroup(metric string, labels []string) metricsGroup {
 	mg := metricsGroup{
+		labels: labels,
 		lineMatchedCntr: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Name: metric,
@@ -47,6 +54,18 @@ func newMetricsGroup(metric string, labels []string) metricsGroup {
 	return mg
 }
 
+// labelsMap create map label name -> value from list of label `names` and
+// list of `values`
+func labelsMap(names, values []string) map[string]string {
+	res := make(map[string]string, len(names))
+	for i, l := range names {
+		if i < len(values) {
+			res[l] = values[i]
+		}
+	}
+	return res
+}
+
 func (m *metricsGroup) register() {
 	prometheus.Register(m.lineMatchedCntr)
 	prometheus.Register(m.lineLastMatch)
@@ -62,6 +81,8 @@ func (m *metricsGroup) unregister() {
 // MetricCollection group prometheus collectors for configured metrics
 type MetricCollection struct {
 	metrics map[string]metricsGroup
+	// sinks get all observed events
+	sinks []Sink
 }
 
 // NewMetricCollection create empty MetricCollection
@@ -83,18 +104,12 @@ func (m *MetricCollection) RegisterMetrics(c *Configuration) {
 				continue
 			}
 
-			var labels []string
-			if len(cm.Labels) > 0 {
-				for k := range cm.Labels {
-					labels = append(labels, k)
-				}
-				sort.Strings(labels)
-				labels = append([]string{"file"}, labels...)
-			} else {
-				labels = []string{"file"}
-			}
+			labels := append([]string{"file"}, cm.labelNames()...)
 
 			m.metrics[cm.Name] = newMetricsGroup(cm.Name, labels)
+			if cm.approximate() {
+				metricApproximate.WithLabelValues(cm.Name).Set(1)
+			}
 			log.Debugf("Registered %s with labels: %#v", cm.Name, labels)
 		}
 	}
@@ -105,24 +120,51 @@ func (m *MetricCollection) UnregisterMetrics() {
 	for _, mg := range m.metrics {
 		mg.unregister()
 	}
+	metricApproximate.Reset()
 	m.metrics = make(map[string]metricsGroup)
 }
 
-// Observe register event for metrics and labels
-func (m *MetricCollection) Observe(metric string, labels []string) {
+// SetSinks replace sinks; previous sinks are closed. Must not be called
+// when workers are running.
+func (m *MetricCollection) SetSinks(sinks []Sink) {
+	for _, s := range m.sinks {
+		if err := s.Close(); err != nil {
+			log.Errorf("close output error: %s", err)
+		}
+	}
+	m.sinks = sinks
+}
+
+// Observe register event for metrics and labels; `weight` is number of
+// records represented by event (when sampling)
+func (m *MetricCollection) Observe(metric string, labels []string, weight float64) {
 	log.Debugf("Observe: %s %#v", metric, labels)
 	mg := m.metrics[metric]
-	mg.lineMatchedCntr.WithLabelValues(labels...).Inc()
+	mg.lineMatchedCntr.WithLabelValues(labels...).Add(weight)
 	mg.lineLastMatch.WithLabelValues(labels...).SetToCurrentTime()
+
+	if len(m.sinks) > 0 {
+		lmap := labelsMap(mg.labels, labels)
+		for _, s := range m.sinks {
+			s.Observe(metric, lmap, weight)
+		}
+	}
 }
 
 // ObserveWV register event for metrics and labels and store value
-func (m *MetricCollection) ObserveWV(metric string, labels []string, value float64) {
+func (m *MetricCollection) ObserveWV(metric string, labels []string, value, weight float64) {
 	log.Debugf("ObserveWV: %s %#v, %v", metric, labels, value)
 	mg := m.metrics[metric]
-	mg.lineMatchedCntr.WithLabelValues(labels...).Inc()
+	mg.lineMatchedCntr.WithLabelValues(labels...).Add(weight)
 	mg.lineLastMatch.WithLabelValues(labels...).SetToCurrentTime()
 	mg.valuesExtracted.WithLabelValues(labels...).Set(value)
+
+	if len(m.sinks) > 0 {
+		lmap := labelsMap(mg.labels, labels)
+		for _, s := range m.sinks {
+			s.ObserveValue(metric, lmap, value, weight)
+		}
+	}
 }
 
 var (
@@ -144,6 +186,97 @@ var (
 		[]string{"file"},
 	)
 
+	queueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "logmonitor",
+			Name:      "queue_length",
+			Help:      "Number of records waiting in worker queue for matching",
+		},
+		[]string{"file"},
+	)
+
+	recordsDroppedCntr = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "logmonitor",
+			Name:      "records_dropped_total",
+			Help:      "Total number records dropped because worker queue was full",
+		},
+		[]string{"file"},
+	)
+
+	recordsSkippedCntr = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "logmonitor",
+			Name:      "records_skipped_total",
+			Help:      "Total number records matched by metric but not counted because of sampling or rate limit",
+		},
+		[]string{"metric", "reason"},
+	)
+
+	metricApproximate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "logmonitor",
+			Name:      "metric_approximate",
+			Help:      "Metric values are approximated because of sampling or rate limit",
+		},
+		[]string{"metric"},
+	)
+
+	patternMatchesCntr = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "logmonitor",
+			Name:      "pattern_matches_total",
+			Help:      "Total number lines matched by pattern",
+		},
+		[]string{"file", "metric", "filter", "type", "pattern"},
+	)
+
+	patternMatchDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "logmonitor",
+			Name:      "pattern_match_duration_seconds",
+			Help:      "Time of matching line by pattern",
+			Buckets:   prometheus.ExponentialBuckets(0.0000001, 4, 10),
+		},
+		[]string{"file", "metric", "filter", "type", "pattern"},
+	)
+
+	bytesReadCntr = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "logmonitor",
+			Name:      "bytes_read_total",
+			Help:      "Total number bytes of messages read by worker",
+		},
+		[]string{"file"},
+	)
+
+	fileLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "logmonitor",
+			Name:      "file_lag_bytes",
+			Help:      "Number of bytes in file not read yet",
+		},
+		[]string{"file"},
+	)
+
+	fileRotationsCntr = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "logmonitor",
+			Name:      "file_rotations_total",
+			Help:      "Total number detected rotations or truncations of file",
+		},
+		[]string{"file"},
+	)
+
+	journalLag = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "logmonitor",
+			Name:      "journal_lag_seconds",
+			Help:      "Difference between time of the newest journal entry and time of last read entry",
+		},
+		[]string{"file"},
+	)
+
 	lineLastProcessed = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "logmonitor",
@@ -158,6 +291,16 @@ func init() {
 	prometheus.MustRegister(lineProcessedCntr)
 	prometheus.MustRegister(lineLastProcessed)
 	prometheus.MustRegister(lineErrosCntr)
+	prometheus.MustRegister(queueLength)
+	prometheus.MustRegister(recordsDroppedCntr)
+	prometheus.MustRegister(bytesReadCntr)
+	prometheus.MustRegister(fileLag)
+	prometheus.MustRegister(fileRotationsCntr)
+	prometheus.MustRegister(journalLag)
+	prometheus.MustRegister(recordsSkippedCntr)
+	prometheus.MustRegister(metricApproximate)
+	prometheus.MustRegister(patternMatchesCntr)
+	prometheus.MustRegister(patternMatchDuration)
 }
 
 // ObserveReadError mark read file error
@@ -170,3 +313,70 @@ func ObserveReadSuccess(filename string) {
 	lineProcessedCntr.WithLabelValues(filename).Inc()
 	lineLastProcessed.WithLabelValues(filename).SetToCurrentTime()
 }
+
+// ObserveBytesRead add number of bytes read
+func ObserveBytesRead(filename string, bytes int) {
+	bytesReadCntr.WithLabelValues(filename).Add(float64(bytes))
+}
+
+// ObserveFileLag set number of bytes not read yet from file
+func ObserveFileLag(filename string, lag int64) {
+	fileLag.WithLabelValues(filename).Set(float64(lag))
+}
+
+// ObserveFileRotated mark file rotation or truncation
+func ObserveFileRotated(filename string) {
+	fileRotationsCntr.WithLabelValues(filename).Inc()
+}
+
+// ObserveJournalLag set delay of reading journal entries
+func ObserveJournalLag(filename string, lag time.Duration) {
+	journalLag.WithLabelValues(filename).Set(lag.Seconds())
+}
+
+// ObserveRecordSkipped mark matched record not counted by metric; `weight`
+// is number of records represented by skipped one
+func ObserveRecordSkipped(metric, reason string, weight float64) {
+	recordsSkippedCntr.WithLabelValues(metric, reason).Add(weight)
+}
+
+// ObserveQueueLength set current length of worker queue
+func ObserveQueueLength(filename string, length int) {
+	queueLength.WithLabelValues(filename).Set(float64(length))
+}
+
+// ObserveRecordDropped mark record dropped because of full queue
+func ObserveRecordDropped(filename string) {
+	recordsDroppedCntr.WithLabelValues(filename).Inc()
+}
+
+// patternStat collect statistics for one pattern
+type patternStat struct {
+	matches  prometheus.Counter
+	duration prometheus.Observer
+}
+
+func newPatternStat(file, metric string, filter int, typ string, pattern int) *patternStat {
+	labels := []string{file, metric, strconv.Itoa(filter), typ, strconv.Itoa(pattern)}
+	return &patternStat{
+		matches:  patternMatchesCntr.WithLabelValues(labels...),
+		duration: patternMatchDuration.WithLabelValues(labels...),
+	}
+}
+
+// match `line` by `r` and observe result
+func (p *patternStat) match(r *regexp.Regexp, line string) bool {
+	start := time.Now()
+	matched := r.MatchString(line)
+	p.duration.Observe(time.Since(start).Seconds())
+	if matched {
+		p.matches.Inc()
+	}
+	return matched
+}
+
+// ResetPatternStats remove statistics for all patterns
+func ResetPatternStats() {
+	patternMatchesCntr.Reset()
+	patternMatchDuration.Reset()
+}
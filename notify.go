@@ -0,0 +1,217 @@
+//
+// notify.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Sending matched records to webhook.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	notifyQueueSize      = 1000
+	notifyInitialBackoff = time.Second
+)
+
+var notifyEventsCntr = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "logmonitor",
+		Name:      "notify_events_total",
+		Help:      "Total number events processed by webhook notifier by result",
+	},
+	[]string{"metric", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(notifyEventsCntr)
+}
+
+// NotifyEvent is one matched record sent to webhook
+type NotifyEvent struct {
+	Metric    string            `json:"metric"`
+	Labels    map[string]string `json:"labels"`
+	Line      string            `json:"line"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Notifier send matched records to webhook in batches
+type Notifier struct {
+	metric string
+	conf   *NotifyConf
+	client *http.Client
+
+	events chan *NotifyEvent
+
+	// rate limiting: number of events in current window
+	windowStart time.Time
+	windowCount int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewNotifier create notifier for `metric`
+func NewNotifier(metric string, conf *NotifyConf) *Notifier {
+	return &Notifier{
+		metric: metric,
+		conf:   conf,
+		client: &http.Client{Timeout: conf.Timeout},
+		events: make(chan *NotifyEvent, notifyQueueSize),
+	}
+}
+
+// Notify queue event for sending; event is dropped when queue is full
+func (n *Notifier) Notify(ev *NotifyEvent) {
+	select {
+	case n.events <- ev:
+	default:
+		notifyEventsCntr.WithLabelValues(n.metric, "dropped").Inc()
+	}
+}
+
+// Start sending events in background
+func (n *Notifier) Start() {
+	n.stop = make(chan struct{})
+	n.done = make(chan struct{})
+
+	go n.loop()
+}
+
+// Stop sending; queued events are sent without retrying
+func (n *Notifier) Stop() {
+	if n.stop == nil {
+		return
+	}
+
+	close(n.stop)
+	<-n.done
+	n.stop = nil
+}
+
+func (n *Notifier) loop() {
+	defer close(n.done)
+
+	ticker := time.NewTicker(n.conf.Interval)
+	defer ticker.Stop()
+
+	var batch []*NotifyEvent
+
+	for {
+		select {
+		case ev := <-n.events:
+			if !n.allow(time.Now()) {
+				notifyEventsCntr.WithLabelValues(n.metric, "rate_limited").Inc()
+				continue
+			}
+			batch = append(batch, ev)
+			if len(batch) >= n.conf.BatchSize {
+				n.send(batch, *n.conf.Retries)
+				batch = nil
+			}
+
+		case <-ticker.C:
+			if len(batch) > 0 {
+				n.send(batch, *n.conf.Retries)
+				batch = nil
+			}
+
+		case <-n.stop:
+			// send remaining events
+			for {
+				select {
+				case ev := <-n.events:
+					if n.allow(time.Now()) {
+						batch = append(batch, ev)
+					} else {
+						notifyEventsCntr.WithLabelValues(n.metric, "rate_limited").Inc()
+					}
+				default:
+					if len(batch) > 0 {
+						n.send(batch, 0)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// allow check rate limit for event
+func (n *Notifier) allow(now time.Time) bool {
+	if n.conf.RateLimit == 0 {
+		return true
+	}
+
+	if now.Sub(n.windowStart) >= n.conf.RateWindow {
+		n.windowStart = now
+		n.windowCount = 0
+	}
+
+	if n.windowCount >= n.conf.RateLimit {
+		return false
+	}
+
+	n.windowCount++
+	return true
+}
+
+// send batch; on error retry up to `retries` times with exponential backoff
+func (n *Notifier) send(batch []*NotifyEvent, retries int) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		log.Errorf("notify %s: encode events error: %s", n.metric, err)
+		notifyEventsCntr.WithLabelValues(n.metric, "failed").Add(float64(len(batch)))
+		return
+	}
+
+	backoff := notifyInitialBackoff
+	for try := 0; ; try++ {
+		err = n.post(data)
+		if err == nil {
+			notifyEventsCntr.WithLabelValues(n.metric, "sent").Add(float64(len(batch)))
+			return
+		}
+
+		if try >= retries {
+			break
+		}
+
+		log.Debugf("notify %s error (retry in %s): %s", n.metric, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-n.stop:
+			// stopping; don't wait
+			retries = try + 1
+		}
+		backoff *= 2
+	}
+
+	log.Errorf("notify %s: send %d events error: %s", n.metric, len(batch), err)
+	notifyEventsCntr.WithLabelValues(n.metric, "failed").Add(float64(len(batch)))
+}
+
+func (n *Notifier) post(data []byte) error {
+	resp, err := n.client.Post(n.conf.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "send request error")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("server returned %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+//
+// notify_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testWebhook struct {
+	mu       sync.Mutex
+	fail     int
+	requests int
+	events   []*NotifyEvent
+}
+
+func (h *testWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.requests++
+	if h.fail > 0 {
+		h.fail--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var events []*NotifyEvent
+	if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	h.events = append(h.events, events...)
+}
+
+func TestNotifierBatchAndRateLimit(t *testing.T) {
+	h := &testWebhook{}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conf := &NotifyConf{URL: srv.URL, RateLimit: 3, Interval: time.Hour}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate error: %s", err)
+	}
+
+	n := NewNotifier("m_notify", conf)
+	n.Start()
+	for i := 0; i < 5; i++ {
+		n.Notify(&NotifyEvent{
+			Metric: "m_notify",
+			Labels: map[string]string{"file": "f1"},
+			Line:   "sudo: session opened",
+		})
+	}
+	n.Stop()
+
+	if h.requests != 1 || len(h.events) != 3 {
+		t.Errorf("invalid requests: %d, events: %d", h.requests, len(h.events))
+	}
+	if len(h.events) > 0 && (h.events[0].Line != "sudo: session opened" ||
+		h.events[0].Labels["file"] != "f1") {
+		t.Errorf("invalid event: %+v", h.events[0])
+	}
+}
+
+func TestNotifierRetry(t *testing.T) {
+	h := &testWebhook{fail: 1}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conf := &NotifyConf{URL: srv.URL, BatchSize: 1}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate error: %s", err)
+	}
+
+	n := NewNotifier("m_notify", conf)
+	n.Start()
+	n.Notify(&NotifyEvent{Metric: "m_notify", Line: "l1"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.Lock()
+		received := len(h.events)
+		h.mu.Unlock()
+		if received > 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	n.Stop()
+
+	if h.requests != 2 || len(h.events) != 1 {
+		t.Errorf("invalid requests: %d, events: %d", h.requests, len(h.events))
+	}
+}
+
+func TestNotifierNoRetries(t *testing.T) {
+	h := &testWebhook{fail: 1}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	retries := 0
+	conf := &NotifyConf{URL: srv.URL, Retries: &retries}
+	if err := conf.validate(); err != nil || *conf.Retries != 0 {
+		t.Fatalf("validate error: %v, retries: %d", err, *conf.Retries)
+	}
+
+	n := NewNotifier("m_notify_noretry", conf)
+	n.send([]*NotifyEvent{&NotifyEvent{Metric: "m_notify_noretry", Line: "l1"}}, *conf.Retries)
+
+	if h.requests != 1 || len(h.events) != 0 {
+		t.Errorf("invalid requests: %d, events: %d", h.requests, len(h.events))
+	}
+
+	conf = &NotifyConf{URL: srv.URL}
+	if err := conf.validate(); err != nil || *conf.Retries != defaultNotifyRetries {
+		t.Errorf("invalid default retries: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+//
+// once.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Batch mode: read all inputs to the end and write metrics.
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// runOnceMode process all configured inputs to the end, then write metrics
+// to file defined by -once.output.
+func runOnceMode(ctx context.Context, c *Configuration) error {
+	initMetrics(c)
+
+	monitors := createWorkers(ctx, c)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+
+loop:
+	for _, m := range monitors {
+		select {
+		case <-m.Done():
+		case <-interrupt:
+			log.Info("interrupted; writing metrics collected so far")
+			break loop
+		}
+	}
+
+	// close outputs
+	closeSinks(stopWorkers(monitors, *shutdownTimeout))
+
+	if err := writeMetrics(*onceOutput, prometheus.DefaultGatherer); err != nil {
+		return err
+	}
+
+	if c.Push != nil {
+		if err := NewPusher(c.Push).Push(); err != nil {
+			return errors.Wrap(err, "push metrics error")
+		}
+	}
+
+	if c.RemoteWrite != nil {
+		// one try to send metrics
+		NewRemoteWriter(c.RemoteWrite).Write(prometheus.DefaultGatherer, time.Now())
+	}
+
+	if c.Textfile != nil {
+		if err := NewTextfileWriter(c.Textfile, prometheus.DefaultGatherer).Write(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeMetrics write metrics from `g` in text exposition format to
+// `filename` ("-" = stdout). Go runtime and process metrics are skipped.
+func writeMetrics(filename string, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return errors.Wrap(err, "gather metrics error")
+	}
+
+	var out io.Writer = os.Stdout
+	if filename != "" && filename != "-" {
+		f, err := os.Create(filename)
+		if err != nil {
+			return errors.Wrap(err, "create output file error")
+		}
+		defer f.Close()
+		out = f
+	}
+
+	return writeMetricFamilies(out, mfs)
+}
+
+// writeMetricFamilies write `mfs` in text exposition format skipping Go
+// runtime and process metrics.
+func writeMetricFamilies(out io.Writer, mfs []*dto.MetricFamily) error {
+	for _, mf := range mfs {
+		if name := mf.GetName(); strings.HasPrefix(name, "go_") ||
+			strings.HasPrefix(name, "process_") {
+			continue
+		}
+		if _, err := expfmt.MetricFamilyToText(out, mf); err != nil {
+			return errors.Wrap(err, "write metrics error")
+		}
+	}
+
+	return nil
+}
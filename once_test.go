@@ -0,0 +1,111 @@
+//
+// once_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdinReader(t *testing.T) {
+	r, _ := (&StdinReader{}).Create(&WorkerConf{File: "-"}, log)
+	sr := r.(*StdinReader)
+	sr.r = strings.NewReader("line1\nline2")
+
+	if prio := sr.Match(&WorkerConf{File: ":stdin"}); prio < 0 {
+		t.Errorf(":stdin not matched")
+	}
+
+	if err := sr.Start(context.Background()); err != nil {
+		t.Fatalf("start error: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, exp := range []string{"line1", "line2"} {
+		rec, err := sr.Read(ctx)
+		if err != nil {
+			t.Fatalf("read error: %s", err)
+		}
+		if rec.Message != exp || rec.Source != "-" {
+			t.Errorf("invalid record: %+v", rec)
+		}
+	}
+
+	if _, err := sr.Read(ctx); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestRunOnceMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logFile := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(logFile, []byte("error 1\ninfo\nerror 2\nwarning\n"), 0644)
+
+	confFile := filepath.Join(dir, "logmonitor.yml")
+	ioutil.WriteFile(confFile, []byte(`
+workers:
+  - file: `+logFile+`
+    metrics:
+      - name: once_test_errors
+        patterns:
+          - include: ["^error"]
+`), 0644)
+
+	output := filepath.Join(dir, "metrics.prom")
+
+	defer func(once bool, out string) {
+		*runOnce, *onceOutput = once, out
+	}(*runOnce, *onceOutput)
+	*runOnce, *onceOutput = true, output
+
+	c, err := LoadConfiguration(confFile, LoadOptions{})
+	if err != nil {
+		t.Fatalf("load configuration error: %s", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- runOnceMode(context.Background(), c)
+	}()
+
+	// end of file finish processing
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("run once error: %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("once mode not finished on end of file")
+	}
+
+	res, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatalf("read output error: %s", err)
+	}
+
+	exp := `once_test_errors{file="` + logFile + `"} 2`
+	if !strings.Contains(string(res), exp) {
+		t.Errorf("missing %q in output:\n%s", exp, res)
+	}
+	if strings.Contains(string(res), "go_goroutines") {
+		t.Errorf("go runtime metrics in output")
+	}
+}
@@ -6,19 +6,44 @@
 package main
 
 import (
+	"context"
 	"github.com/hpcloud/tail"
 	"github.com/pkg/errors"
+	"io"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
 // PlainFileReader read plain file
 type PlainFileReader struct {
+	// offset is position after last line returned by Read; tail position
+	// (Tell) is ahead of lines waiting in tail.Lines. Accessed atomically
+	// (first field for alignment).
+	offset int64
+
 	c *WorkerConf
 	t *tail.Tail
 
+	// lines read from rotated files on start
+	backfill chan backfillLine
+	// backfillPos is position after last backfilled line returned by Read;
+	// nil when no line was returned
+	backfillPos *fileStamp
+
+	// state of file for detecting rotation; used only by checkLoop
+	inode uint64
+	size  int64
+	// stopCheck stop checkLoop; checkDone is closed when checkLoop finish
+	stopCheck chan struct{}
+	checkDone chan struct{}
+
 	log logger
 }
 
+// interval between checking file size and rotation
+const plainFileCheckInterval = time.Second
+
 func init() {
 	MustRegisterReader(&PlainFileReader{})
 }
@@ -26,7 +51,7 @@ func init() {
 // Match reader to configuration file.
 // PlainFileReader has very low priority and cannot be used when file start with ":"
 func (p *PlainFileReader) Match(conf *WorkerConf) (prio int) {
-	if conf.File[0] == ':' {
+	if conf.File == "" || conf.File[0] == ':' {
 		return -1
 	}
 	return 0
@@ -43,43 +68,208 @@ func (p *PlainFileReader) Create(conf *WorkerConf, l logger) (pfr Reader, err er
 }
 
 // Start worker (reading file)
-func (p *PlainFileReader) Start() (err error) {
+func (p *PlainFileReader) Start(ctx context.Context) (err error) {
 	if p.t != nil {
 		return errors.Errorf("already reading")
 	}
 
-	p.t, err = tail.TailFile(p.c.File,
-		tail.Config{
-			Follow:   true,
-			ReOpen:   true,
-			Location: &tail.SeekInfo{Offset: 0, Whence: os.SEEK_END},
-			Logger:   tail.DiscardingLogger,
-			Poll:     p.c.Options["poll"] == "yes",
-			Pipe:     p.c.Options["pipe"] == "yes",
-		},
-	)
+	location := &tail.SeekInfo{Offset: 0, Whence: os.SEEK_END}
+
+	// in once mode position from stamp is not used (nor saved)
+	var stamp *fileStamp
+	if p.c.StampFile != "" && !*runOnce {
+		stamp = loadFileStamp(p.c.StampFile)
+	}
+
+	if p.c.Options["backfill"] == "yes" {
+		files, offset, err := prepareBackfill(p.c.File, stamp)
+		if err != nil {
+			return errors.Wrap(err, "prepare backfill error")
+		}
+		// read live file from beginning (or saved position) after backfill
+		location = &tail.SeekInfo{Offset: p.checkOffset(offset), Whence: os.SEEK_SET}
+
+		p.backfill = make(chan backfillLine)
+		go readBackfill(files, p.backfill, ctx.Done(), p.log)
+	} else if stamp != nil {
+		if fi, err := os.Stat(p.c.File); err == nil && fileInode(fi) == stamp.inode {
+			location = &tail.SeekInfo{Offset: p.checkOffset(stamp.offset), Whence: os.SEEK_SET}
+		}
+	}
+
+	p.offset = location.Offset
+	if location.Whence == os.SEEK_END {
+		p.offset = 0
+		if fi, err := os.Stat(p.c.File); err == nil {
+			p.offset = fi.Size()
+		}
+	}
+
+	if p.t, err = tailFile(p.c, location); err != nil {
+		return errors.Wrap(err, "open file error")
+	}
+
+	p.stopCheck = make(chan struct{})
+	p.checkDone = make(chan struct{})
+	go p.checkLoop(ctx)
+
+	return nil
+}
+
+// checkOffset return `offset` or 0 when file is smaller than offset
+// (i.e. was truncated).
+func (p *PlainFileReader) checkOffset(offset int64) int64 {
+	if fi, err := os.Stat(p.c.File); err == nil && fi.Size() >= offset {
+		return offset
+	}
+	return 0
+}
+
+// tailFile start following file according to worker configuration.
+// In "once" mode file is read from beginning (or given offset) to end.
+func tailFile(conf *WorkerConf, location *tail.SeekInfo) (*tail.Tail, error) {
+	cfg := tail.Config{
+		Follow:   true,
+		ReOpen:   true,
+		Location: location,
+		Logger:   tail.DiscardingLogger,
+		Poll:     conf.Options["poll"] == "yes",
+		Pipe:     conf.Options["pipe"] == "yes",
+	}
+
+	if *runOnce {
+		cfg.Follow = false
+		cfg.ReOpen = false
+		if location.Whence == os.SEEK_END {
+			cfg.Location = nil
+		}
+	}
 
-	return errors.Wrap(err, "open file error")
+	return tail.TailFile(conf.File, cfg)
 }
 
 // Stop reading plain file
 func (p *PlainFileReader) Stop() error {
 	if p.t != nil {
+		close(p.stopCheck)
+		<-p.checkDone
+
+		// in once mode file is read by other instance; don't overwrite its
+		// position
+		if p.c.StampFile != "" && !*runOnce {
+			p.saveStamp()
+		}
+
+		// tail may be blocked on sending line read ahead; discard lines
+		// until tail close channel
+		go func(lines <-chan *tail.Line) {
+			for range lines {
+			}
+		}(p.t.Lines)
+
 		p.t.Stop()
 		p.t = nil
 	}
 	return nil
 }
 
-func (p *PlainFileReader) Read() (line string, err error) {
+// saveStamp save position in live file or, when backfill is not finished,
+// position in backfilled file. When no backfilled line was read previous
+// stamp is kept.
+func (p *PlainFileReader) saveStamp() {
+	var err error
+	if p.backfill == nil {
+		err = saveFileStamp(p.c.StampFile, p.c.File, atomic.LoadInt64(&p.offset))
+	} else if p.backfillPos != nil {
+		err = writeFileStamp(p.c.StampFile, p.backfillPos)
+	}
+	if err != nil {
+		p.log.Warnf("save position error: %s", err)
+	}
+}
+
+// checkLoop check file every plainFileCheckInterval until reader is
+// stopped
+func (p *PlainFileReader) checkLoop(ctx context.Context) {
+	defer close(p.checkDone)
+
+	ticker := time.NewTicker(plainFileCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.checkFile()
+		case <-ctx.Done():
+			return
+		case <-p.stopCheck:
+			return
+		}
+	}
+}
+
+// checkFile update file lag (bytes after last returned line) and detect
+// rotation (inode change or truncation)
+func (p *PlainFileReader) checkFile() {
+	fi, err := os.Stat(p.c.File)
+	if err != nil {
+		return
+	}
+
+	inode, size := fileInode(fi), fi.Size()
+	if p.inode != 0 && (inode != p.inode || size < p.size) {
+		ObserveFileRotated(p.c.File)
+	}
+	p.inode, p.size = inode, size
+
+	if offset := atomic.LoadInt64(&p.offset); size >= offset {
+		ObserveFileLag(p.c.File, size-offset)
+	}
+}
+
+// consumed update position after line of `size` bytes (with new line) is
+// returned. When tail position is before computed position tail reopened
+// file (rotation, truncation) and line is assumed to be the first line in
+// new file. In once mode file is not reopened and tail close file on end
+// (Tell is not safe then).
+func (p *PlainFileReader) consumed(size int) {
+	offset := atomic.AddInt64(&p.offset, int64(size))
+	if *runOnce {
+		return
+	}
+	if pos, err := p.t.Tell(); err == nil && pos < offset {
+		atomic.StoreInt64(&p.offset, int64(size))
+	}
+}
+
+func (p *PlainFileReader) Read(ctx context.Context) (rec *Record, err error) {
 	if p.t == nil {
-		return "", errors.New("file not opened")
+		return nil, errors.New("file not opened")
 	}
 
-	if l, ok := <-p.t.Lines; ok {
-		return l.Text, errors.Wrap(l.Err, "read line error")
+	if p.backfill != nil {
+		select {
+		case l, ok := <-p.backfill:
+			if ok {
+				p.backfillPos = &l.pos
+				return NewRecord(l.text, p.c.File), nil
+			}
+			// backfill finished
+			p.backfill = nil
+			p.backfillPos = nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
-	// eof
-	return "", nil
+	select {
+	case l, ok := <-p.t.Lines:
+		if ok {
+			p.consumed(len(l.Text) + 1)
+			return NewRecord(l.Text, p.c.File), errors.Wrap(l.Err, "read line error")
+		}
+		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
@@ -0,0 +1,116 @@
+//
+// push.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Pushing metrics to Prometheus Pushgateway.
+
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+const pushTimeout = 10 * time.Second
+
+var pushErrorsCntr = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "logmonitor",
+		Name:      "push_errors_total",
+		Help:      "Total number errors while pushing metrics to Pushgateway",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(pushErrorsCntr)
+}
+
+// Pusher periodically push all metrics to Pushgateway
+type Pusher struct {
+	conf   *PushConf
+	pusher *push.Pusher
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewPusher create pusher according to configuration
+func NewPusher(conf *PushConf) *Pusher {
+	pusher := push.New(conf.URL, conf.Job).
+		Gatherer(prometheus.DefaultGatherer).
+		Client(&http.Client{Timeout: pushTimeout})
+
+	for k, v := range conf.Grouping {
+		pusher = pusher.Grouping(k, v)
+	}
+
+	return &Pusher{
+		conf:   conf,
+		pusher: pusher,
+	}
+}
+
+// Start pushing metrics in background
+func (p *Pusher) Start() {
+	log.Infof("Pushing metrics to %s every %s", p.conf.URL, p.conf.Interval)
+
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+
+	go func() {
+		defer close(p.done)
+
+		ticker := time.NewTicker(p.conf.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				p.Push()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop pushing in background and push metrics last time
+func (p *Pusher) Stop() {
+	if p == nil {
+		return
+	}
+
+	if p.stop != nil {
+		close(p.stop)
+		<-p.done
+		p.stop = nil
+	}
+
+	p.Push()
+}
+
+// Push metrics to Pushgateway
+func (p *Pusher) Push() error {
+	err := p.pusher.Push()
+	if err != nil {
+		pushErrorsCntr.Inc()
+		log.Errorf("push metrics to %s error: %s", p.conf.URL, err)
+	} else {
+		log.Debugf("metrics pushed to %s", p.conf.URL)
+	}
+	return err
+}
+
+// startPusher create and start pusher when pushing is configured
+func startPusher(c *Configuration) *Pusher {
+	if c.Push == nil {
+		return nil
+	}
+
+	p := NewPusher(c.Push)
+	p.Start()
+	return p
+}
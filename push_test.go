@@ -0,0 +1,73 @@
+//
+// push_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPusher(t *testing.T) {
+	requests := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "PUT" || !strings.Contains(string(body), "logmonitor_lines_processed_total") {
+			t.Errorf("invalid request: %s %q", r.Method, body)
+		}
+		requests <- r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	ObserveReadSuccess("push_test")
+
+	conf := &PushConf{
+		URL:      srv.URL,
+		Interval: 50 * time.Millisecond,
+		Grouping: map[string]string{"instance": "host1", "dc": "dc1"},
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate error: %s", err)
+	}
+
+	p := NewPusher(conf)
+	p.Start()
+
+	select {
+	case path := <-requests:
+		// order of grouping labels is not defined
+		if !strings.HasPrefix(path, "/metrics/job/logmonitor/") ||
+			!strings.Contains(path, "/dc/dc1") || !strings.Contains(path, "/instance/host1") {
+			t.Errorf("invalid path: %s", path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout while waiting for push")
+	}
+
+	// last push on stop
+	for len(requests) > 0 {
+		<-requests
+	}
+	p.Stop()
+	if len(requests) == 0 {
+		t.Errorf("missing push on stop")
+	}
+}
+
+func TestPushConfValidate(t *testing.T) {
+	if err := (&PushConf{}).validate(); err == nil {
+		t.Errorf("missing error for empty url")
+	}
+	if err := (&PushConf{URL: "http://a", Grouping: map[string]string{"1a": "b"}}).validate(); err == nil {
+		t.Errorf("missing error for invalid grouping label")
+	}
+}
@@ -0,0 +1,132 @@
+//
+// record.go
+// Copyright (C) Karol Będkowski, 2017
+//
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Record is one entry read by Reader
+type Record struct {
+	// Message is main text of record (line, journal MESSAGE)
+	Message string
+	// Fields are additional data provided by reader (journal fields, stream...)
+	Fields map[string]string
+	// Time of record; zero when unknown
+	Time time.Time
+	// Source of record (i.e. file name)
+	Source string
+}
+
+// NewRecord create record for plain `line` read from `source`
+func NewRecord(line, source string) *Record {
+	return &Record{
+		Message: line,
+		Source:  source,
+	}
+}
+
+// Field return value of field `name`; empty name or "MESSAGE" return
+// Message.
+func (r *Record) Field(name string) (value string, ok bool) {
+	if name == "" {
+		return r.Message, true
+	}
+
+	if value, ok = r.Fields[name]; ok {
+		return
+	}
+
+	if name == "MESSAGE" {
+		return r.Message, true
+	}
+
+	return "", false
+}
+
+// journalRecordTime parse __REALTIME_TIMESTAMP field (microseconds)
+func journalRecordTime(fields map[string]string) time.Time {
+	if ts, ok := fields["__REALTIME_TIMESTAMP"]; ok {
+		if usec, err := strconv.ParseInt(ts, 10, 64); err == nil {
+			return time.Unix(usec/1000000, (usec%1000000)*1000)
+		}
+	}
+	return time.Time{}
+}
+
+// LineReader is interface for readers that return only plain lines and
+// don't support context. Use WrapLineReader to create Reader from it.
+type LineReader interface {
+	Start() error
+	Read() (line string, err error)
+	Stop() error
+}
+
+type lineReaderAdapter struct {
+	LineReader
+	source string
+
+	stopOnce sync.Once
+	stopErr  error
+	// closed when reader is stopped
+	stopped chan struct{}
+}
+
+// WrapLineReader create Reader from LineReader; records get only Message
+// and Source.
+func WrapLineReader(r LineReader, source string) Reader {
+	return &lineReaderAdapter{
+		LineReader: r,
+		source:     source,
+		stopped:    make(chan struct{}),
+	}
+}
+
+// Start wrapped reader. LineReader may block in Read until stopped, so it
+// is stopped when context is cancelled.
+func (l *lineReaderAdapter) Start(ctx context.Context) error {
+	if err := l.LineReader.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Stop()
+		case <-l.stopped:
+		}
+	}()
+
+	return nil
+}
+
+// Read line from wrapped reader.
+func (l *lineReaderAdapter) Read(ctx context.Context) (*Record, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	line, err := l.LineReader.Read()
+	if line == "" {
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	return NewRecord(line, l.source), err
+}
+
+// Stop wrapped reader; may be called many times.
+func (l *lineReaderAdapter) Stop() error {
+	l.stopOnce.Do(func() {
+		l.stopErr = l.LineReader.Stop()
+		close(l.stopped)
+	})
+	return l.stopErr
+}
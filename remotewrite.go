@@ -0,0 +1,407 @@
+//
+// remotewrite.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Sending metrics by Prometheus remote_write protocol (snappy-compressed
+// protobuf WriteRequest).
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	remoteWriteSamplesSent = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "logmonitor",
+			Name:      "remote_write_samples_sent_total",
+			Help:      "Total number samples sent by remote write",
+		},
+	)
+
+	remoteWriteSamplesFailed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "logmonitor",
+			Name:      "remote_write_samples_failed_total",
+			Help:      "Total number samples dropped because of remote write errors",
+		},
+	)
+
+	remoteWritePending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "logmonitor",
+			Name:      "remote_write_pending_requests",
+			Help:      "Number of requests waiting for send by remote write",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(remoteWriteSamplesSent)
+	prometheus.MustRegister(remoteWriteSamplesFailed)
+	prometheus.MustRegister(remoteWritePending)
+}
+
+// rwSample is one sample of time series
+type rwSample struct {
+	// labels sorted by name; include __name__
+	labels [][2]string
+	value  float64
+}
+
+// rwRequest is encoded and compressed WriteRequest waiting for send
+type rwRequest struct {
+	data    []byte
+	samples int
+}
+
+// RemoteWriter periodically send all metrics to remote write endpoint.
+// Requests are sent in background goroutine so slow endpoint don't delay
+// gathering; requests that can't be sent are buffered and retried.
+type RemoteWriter struct {
+	conf   *RemoteWriteConf
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []*rwRequest
+	// sending is true when first pending request is being sent
+	sending bool
+
+	// wake notify sending goroutine about new request
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewRemoteWriter create writer according to configuration
+func NewRemoteWriter(conf *RemoteWriteConf) *RemoteWriter {
+	return &RemoteWriter{
+		conf:   conf,
+		client: &http.Client{Timeout: conf.Timeout},
+	}
+}
+
+// Start gathering and sending metrics in background
+func (r *RemoteWriter) Start() {
+	log.Infof("Sending metrics to %s every %s", r.conf.URL, r.conf.Interval)
+
+	r.stop = make(chan struct{})
+	r.wake = make(chan struct{}, 1)
+
+	r.wg.Add(2)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.conf.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				r.collect(prometheus.DefaultGatherer, time.Now())
+				select {
+				case r.wake <- struct{}{}:
+				default:
+					// sending in progress
+				}
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer r.wg.Done()
+
+		for {
+			select {
+			case <-r.wake:
+				r.flush()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop sending in background and try send metrics last time
+func (r *RemoteWriter) Stop() {
+	if r == nil {
+		return
+	}
+
+	if r.stop != nil {
+		close(r.stop)
+		r.wg.Wait()
+		r.stop = nil
+	}
+
+	r.Write(prometheus.DefaultGatherer, time.Now())
+}
+
+// Write gather metrics from `g`, add request to queue and send all pending
+// requests.
+func (r *RemoteWriter) Write(g prometheus.Gatherer, now time.Time) {
+	r.collect(g, now)
+	r.flush()
+}
+
+// collect gather metrics from `g` and add request to queue
+func (r *RemoteWriter) collect(g prometheus.Gatherer, now time.Time) {
+	mfs, err := g.Gather()
+	if err != nil {
+		log.Errorf("remote write: gather metrics error: %s", err)
+	}
+
+	samples := convertMetricFamilies(mfs, r.conf.ExternalLabels)
+	if len(samples) > 0 {
+		data := encodeWriteRequest(samples, now)
+		r.enqueue(&rwRequest{snappy.Encode(nil, data), len(samples)})
+	}
+}
+
+// enqueue add request to queue; when queue is full the oldest request
+// (not being sent) is dropped
+func (r *RemoteWriter) enqueue(req *rwRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.pending) >= r.conf.BufferSize {
+		idx := 0
+		if r.sending {
+			idx = 1
+		}
+		if idx < len(r.pending) {
+			dropped := r.pending[idx]
+			r.pending = append(r.pending[:idx], r.pending[idx+1:]...)
+			remoteWriteSamplesFailed.Add(float64(dropped.samples))
+			log.Warnf("remote write: buffer full; dropped %d samples", dropped.samples)
+		}
+	}
+	r.pending = append(r.pending, req)
+	remoteWritePending.Set(float64(len(r.pending)))
+}
+
+// flush send pending requests in order; stop on first recoverable error.
+// Must not be called concurrently.
+func (r *RemoteWriter) flush() {
+	for {
+		r.mu.Lock()
+		if len(r.pending) == 0 {
+			r.mu.Unlock()
+			return
+		}
+		req := r.pending[0]
+		r.sending = true
+		r.mu.Unlock()
+
+		recoverable, err := r.send(req.data)
+
+		r.mu.Lock()
+		r.sending = false
+		if err != nil && recoverable {
+			r.mu.Unlock()
+			log.Warnf("remote write to %s error (will retry): %s", r.conf.URL, err)
+			return
+		}
+		r.pending = r.pending[1:]
+		remoteWritePending.Set(float64(len(r.pending)))
+		r.mu.Unlock()
+
+		if err != nil {
+			log.Errorf("remote write to %s error: %s", r.conf.URL, err)
+			remoteWriteSamplesFailed.Add(float64(req.samples))
+		} else {
+			remoteWriteSamplesSent.Add(float64(req.samples))
+		}
+	}
+}
+
+// send one request; return true when error is recoverable (network error,
+// 5xx, 429)
+func (r *RemoteWriter) send(data []byte) (recoverable bool, err error) {
+	req, err := http.NewRequest("POST", r.conf.URL, bytes.NewReader(data))
+	if err != nil {
+		return false, errors.Wrap(err, "create request error")
+	}
+
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "logmonitor")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "send request error")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return false, nil
+	}
+
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+	err = errors.Errorf("server returned %s: %s", resp.Status,
+		strings.TrimSpace(string(body)))
+
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// startRemoteWriter create and start writer when remote write is configured
+func startRemoteWriter(c *Configuration) *RemoteWriter {
+	if c.RemoteWrite == nil {
+		return nil
+	}
+
+	r := NewRemoteWriter(c.RemoteWrite)
+	r.Start()
+	return r
+}
+
+// convertMetricFamilies create samples from metrics; `external` labels are
+// added when metric don't have label with the same name. Go runtime and
+// process metrics are skipped.
+func convertMetricFamilies(mfs []*dto.MetricFamily, external map[string]string) (samples []rwSample) {
+	for _, mf := range mfs {
+		name := mf.GetName()
+		if strings.HasPrefix(name, "go_") || strings.HasPrefix(name, "process_") {
+			continue
+		}
+
+		for _, m := range mf.Metric {
+			add := func(suffix string, value float64, extra ...string) {
+				labels := [][2]string{{"__name__", name + suffix}}
+				for _, lp := range m.Label {
+					// empty label is the same as missing label
+					if lp.GetValue() != "" {
+						labels = append(labels, [2]string{lp.GetName(), lp.GetValue()})
+					}
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					labels = append(labels, [2]string{extra[i], extra[i+1]})
+				}
+				for name, value := range external {
+					if !hasLabel(labels, name) {
+						labels = append(labels, [2]string{name, value})
+					}
+				}
+				sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+				samples = append(samples, rwSample{labels, value})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add("", m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.Bucket {
+					add("_bucket", float64(b.GetCumulativeCount()),
+						"le", formatFloat(b.GetUpperBound()))
+				}
+				add("_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					add("", q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			}
+		}
+	}
+
+	return
+}
+
+func hasLabel(labels [][2]string, name string) bool {
+	for _, l := range labels {
+		if l[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encode samples as protobuf WriteRequest:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(samples []rwSample, now time.Time) []byte {
+	ts := now.UnixNano() / int64(time.Millisecond)
+
+	var req, series, msg []byte
+	for _, s := range samples {
+		series = series[:0]
+		for _, l := range s.labels {
+			msg = msg[:0]
+			msg = appendBytesField(msg, 1, []byte(l[0]))
+			msg = appendBytesField(msg, 2, []byte(l[1]))
+			series = appendBytesField(series, 1, msg)
+		}
+
+		msg = msg[:0]
+		msg = appendKey(msg, 1, 1) // fixed64
+		msg = appendFixed64(msg, math.Float64bits(s.value))
+		msg = appendKey(msg, 2, 0) // varint
+		msg = appendVarint(msg, uint64(ts))
+		series = appendBytesField(series, 2, msg)
+
+		req = appendBytesField(req, 1, series)
+	}
+
+	return req
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendKey(b []byte, field int, wireType int) []byte {
+	return appendVarint(b, uint64(field<<3|wireType))
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = appendKey(b, field, 2) // length-delimited
+	b = appendVarint(b, uint64(len(data)))
+	return append(b, data...)
+}
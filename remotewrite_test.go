@@ -0,0 +1,208 @@
+//
+// remotewrite_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// decodeMessage split protobuf message into list of (field, value) for
+// length-delimited, fixed64 and varint fields
+func decodeMessage(t *testing.T, data []byte) (fields []int, values [][]byte) {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		field, wireType := int(key>>3), int(key&7)
+		switch wireType {
+		case 0:
+			_, n = binary.Uvarint(data)
+			values = append(values, data[:n])
+			data = data[n:]
+		case 1:
+			values = append(values, data[:8])
+			data = data[8:]
+		case 2:
+			l, n := binary.Uvarint(data)
+			data = data[n:]
+			values = append(values, data[:l])
+			data = data[l:]
+		default:
+			t.Fatalf("unexpected wire type %d", wireType)
+		}
+		fields = append(fields, field)
+	}
+	return
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	samples := []rwSample{
+		{[][2]string{{"__name__", "m1"}, {"file", "f1"}}, 2.5},
+	}
+	data := encodeWriteRequest(samples, time.Unix(10, 0))
+
+	fields, values := decodeMessage(t, data)
+	if len(fields) != 1 || fields[0] != 1 {
+		t.Fatalf("invalid write request: %v", fields)
+	}
+
+	fields, values = decodeMessage(t, values[0])
+	if len(fields) != 3 || fields[0] != 1 || fields[1] != 1 || fields[2] != 2 {
+		t.Fatalf("invalid time series: %v", fields)
+	}
+
+	_, label := decodeMessage(t, values[1])
+	if string(label[0]) != "file" || string(label[1]) != "f1" {
+		t.Errorf("invalid label: %q", label)
+	}
+
+	_, sample := decodeMessage(t, values[2])
+	ts, _ := binary.Uvarint(sample[1])
+	if binary.LittleEndian.Uint64(sample[0]) != 0x4004000000000000 || ts != 10000 {
+		t.Errorf("invalid sample: %v", sample)
+	}
+}
+
+func TestRemoteWriterRetry(t *testing.T) {
+	fail := true
+	received := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" {
+			t.Errorf("invalid content encoding")
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if _, err := snappy.Decode(nil, body); err != nil {
+			t.Errorf("decode body error: %s", err)
+		}
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	cntr := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "test"})
+	reg.MustRegister(cntr)
+
+	conf := &RemoteWriteConf{URL: srv.URL, BufferSize: 2}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate error: %s", err)
+	}
+	rw := NewRemoteWriter(conf)
+
+	for i := 0; i < 3; i++ {
+		rw.Write(reg, time.Now())
+	}
+	if len(rw.pending) != 2 {
+		t.Errorf("invalid number of pending requests: %d", len(rw.pending))
+	}
+
+	fail = false
+	rw.Write(reg, time.Now())
+	if len(rw.pending) != 0 || received != 2 {
+		t.Errorf("pending requests not sent: %d, %d", len(rw.pending), received)
+	}
+}
+
+func TestRemoteWriteExternalLabels(t *testing.T) {
+	conf := &RemoteWriteConf{URL: "http://localhost/"}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate error: %s", err)
+	}
+	if hostname, _ := os.Hostname(); conf.ExternalLabels["instance"] != hostname {
+		t.Errorf("invalid default external labels: %v", conf.ExternalLabels)
+	}
+
+	conf = &RemoteWriteConf{URL: "http://localhost/", ExternalLabels: map[string]string{}}
+	if err := conf.validate(); err != nil || len(conf.ExternalLabels) != 0 {
+		t.Errorf("default labels added to empty external labels: %v, %v", conf.ExternalLabels, err)
+	}
+
+	conf.ExternalLabels = map[string]string{"__name__": "x"}
+	if err := conf.validate(); err == nil {
+		t.Errorf("invalid label name accepted")
+	}
+
+	reg := prometheus.NewRegistry()
+	cntr := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total", Help: "test"},
+		[]string{"instance", "file"})
+	reg.MustRegister(cntr)
+	cntr.WithLabelValues("", "f1").Inc()
+	cntr.WithLabelValues("other", "f2").Inc()
+
+	mfs, _ := reg.Gather()
+	samples := convertMetricFamilies(mfs, map[string]string{"instance": "host1", "env": "prod"})
+	if len(samples) != 2 {
+		t.Fatalf("invalid samples: %v", samples)
+	}
+	// empty label is missing label, so external label is added
+	exp := [][][2]string{
+		{{"__name__", "test_total"}, {"env", "prod"}, {"file", "f1"}, {"instance", "host1"}},
+		{{"__name__", "test_total"}, {"env", "prod"}, {"file", "f2"}, {"instance", "other"}},
+	}
+	for i, s := range samples {
+		if !reflect.DeepEqual(s.labels, exp[i]) {
+			t.Errorf("invalid labels: %v, expected %v", s.labels, exp[i])
+		}
+	}
+}
+
+func TestRemoteWriterAsync(t *testing.T) {
+	release := make(chan struct{})
+	requests := make(chan struct{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- struct{}{}:
+		default:
+		}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	conf := &RemoteWriteConf{URL: srv.URL, Interval: 10 * time.Millisecond}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate error: %s", err)
+	}
+	rw := NewRemoteWriter(conf)
+	rw.Start()
+
+	select {
+	case <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no request sent")
+	}
+
+	// endpoint is blocked; metrics are still gathered
+	time.Sleep(100 * time.Millisecond)
+	rw.mu.Lock()
+	pending := len(rw.pending)
+	rw.mu.Unlock()
+	if pending < 3 {
+		t.Errorf("gathering blocked by sending; pending: %d", pending)
+	}
+
+	close(release)
+	rw.Stop()
+
+	if len(rw.pending) != 0 {
+		t.Errorf("pending requests not sent: %d", len(rw.pending))
+	}
+}
@@ -0,0 +1,93 @@
+//
+// sampler.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Sampling and rate limiting of records evaluated by metric.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	skipReasonSampling  = "sampling"
+	skipReasonRateLimit = "rate_limit"
+)
+
+// sampler decide which records are evaluated (or matched records counted)
+// by metric
+type sampler struct {
+	mu sync.Mutex
+
+	// rate is fraction of records taken (0, 1)
+	rate float64
+	// number of records seen and taken by sampling
+	seen, taken uint64
+
+	// maxPerSecond limit number of counted records; 0 = no limit
+	maxPerSecond float64
+	tokens       float64
+	last         time.Time
+}
+
+// newSampler create sampler for metric; return nil when sampling and
+// limiting is disabled.
+func newSampler(rate float64, maxPerSecond int) *sampler {
+	if rate >= 1 {
+		rate = 0
+	}
+
+	if rate <= 0 && maxPerSecond <= 0 {
+		return nil
+	}
+
+	return &sampler{
+		rate:         rate,
+		maxPerSecond: float64(maxPerSecond),
+		tokens:       float64(maxPerSecond),
+	}
+}
+
+// allow check if record should be evaluated (counted). Return weight of
+// record (how many records it represent) and reason of skipping; skipped
+// record has weight 1 when skipped by sampling (counter is already scaled)
+// or its weight when skipped by rate limit.
+func (s *sampler) allow(now time.Time) (weight float64, skipReason string) {
+	if s == nil {
+		return 1, ""
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	weight = 1
+
+	if s.rate > 0 {
+		// take record when number of taken records fall below expected
+		s.seen++
+		if float64(s.taken) >= float64(s.seen)*s.rate {
+			return 1, skipReasonSampling
+		}
+		s.taken++
+		weight = 1 / s.rate
+	}
+
+	if s.maxPerSecond > 0 {
+		if !s.last.IsZero() {
+			s.tokens += now.Sub(s.last).Seconds() * s.maxPerSecond
+			if s.tokens > s.maxPerSecond {
+				s.tokens = s.maxPerSecond
+			}
+		}
+		s.last = now
+
+		if s.tokens < 1 {
+			return weight, skipReasonRateLimit
+		}
+		s.tokens--
+	}
+
+	return weight, ""
+}
@@ -0,0 +1,94 @@
+//
+// sampler_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSamplerRate(t *testing.T) {
+	s := newSampler(0.25, 0)
+	now := time.Now()
+
+	taken := 0
+	for i := 0; i < 100; i++ {
+		weight, reason := s.allow(now)
+		if reason == "" {
+			taken++
+			if weight != 4 {
+				t.Errorf("invalid weight: %v", weight)
+			}
+		} else if reason != skipReasonSampling {
+			t.Errorf("invalid skip reason: %v", reason)
+		}
+	}
+
+	if taken != 25 {
+		t.Errorf("invalid number of taken records: %d", taken)
+	}
+}
+
+func TestSamplerMaxPerSecond(t *testing.T) {
+	s := newSampler(0, 10)
+	now := time.Now()
+
+	taken := 0
+	for i := 0; i < 20; i++ {
+		if w, reason := s.allow(now); reason == "" && w == 1 {
+			taken++
+		}
+	}
+	if taken != 10 {
+		t.Errorf("invalid number of taken records: %d", taken)
+	}
+
+	// after 0.5s 5 tokens should be available
+	now = now.Add(500 * time.Millisecond)
+	taken = 0
+	for i := 0; i < 20; i++ {
+		if _, reason := s.allow(now); reason == "" {
+			taken++
+		}
+	}
+	if taken != 5 {
+		t.Errorf("invalid number of taken records after 0.5s: %d", taken)
+	}
+}
+
+func TestSamplerDisabled(t *testing.T) {
+	if s := newSampler(1, 0); s != nil {
+		t.Errorf("sampler should be disabled")
+	}
+
+	var s *sampler
+	if w, reason := s.allow(time.Now()); w != 1 || reason != "" {
+		t.Errorf("nil sampler should accept all records")
+	}
+}
+
+func TestSamplerSkippedWeight(t *testing.T) {
+	s := newSampler(0.5, 1)
+	now := time.Now()
+
+	var counted, skipped float64
+	for i := 0; i < 10; i++ {
+		weight, reason := s.allow(now)
+		switch reason {
+		case "":
+			counted += weight
+		case skipReasonRateLimit:
+			skipped += weight
+		}
+	}
+
+	// 5 records taken by sampling (weight 2); 1 counted, 4 limited
+	if counted != 2 || skipped != 8 {
+		t.Errorf("invalid weights: counted %v, skipped %v", counted, skipped)
+	}
+}
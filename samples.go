@@ -0,0 +1,179 @@
+//
+// samples.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Keeping last lines accepted by metrics and exposing them over http.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sample is one line accepted by metric
+type Sample struct {
+	Time   time.Time         `json:"time"`
+	Line   string            `json:"line"`
+	Labels map[string]string `json:"labels"`
+}
+
+// sampleBuffer keep last accepted lines in ring buffer
+type sampleBuffer struct {
+	mu      sync.Mutex
+	samples []*Sample
+	// next is position for next sample
+	next int
+	full bool
+}
+
+func newSampleBuffer(size int) *sampleBuffer {
+	return &sampleBuffer{samples: make([]*Sample, size)}
+}
+
+// add sample; the oldest sample is removed when buffer is full
+func (s *sampleBuffer) add(sample *Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples[s.next] = sample
+	s.next++
+	if s.next == len(s.samples) {
+		s.next = 0
+		s.full = true
+	}
+}
+
+// list return samples; newest first
+func (s *sampleBuffer) list() []*Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := s.next
+	if s.full {
+		n = len(s.samples)
+	}
+
+	res := make([]*Sample, 0, n)
+	for i := 1; i <= n; i++ {
+		idx := (s.next - i + len(s.samples)) % len(s.samples)
+		res = append(res, s.samples[idx])
+	}
+	return res
+}
+
+// samplesStore keep sample buffers for metrics
+var samplesStore struct {
+	mu      sync.RWMutex
+	buffers map[string]*sampleBuffer
+}
+
+// initSamples create buffers for metrics with configured samples; previous
+// samples are removed
+func initSamples(c *Configuration) {
+	buffers := make(map[string]*sampleBuffer)
+
+	for _, f := range c.Workers {
+		if f.Disabled {
+			continue
+		}
+		for _, m := range f.Metrics {
+			if m.Disabled || m.Samples <= 0 {
+				continue
+			}
+			// the same metric may be defined in many workers; use largest size
+			if b, ok := buffers[m.Name]; !ok || len(b.samples) < m.Samples {
+				buffers[m.Name] = newSampleBuffer(m.Samples)
+			}
+		}
+	}
+
+	samplesStore.mu.Lock()
+	defer samplesStore.mu.Unlock()
+	samplesStore.buffers = buffers
+}
+
+// getSampleBuffer return buffer for `metric` or nil when samples are not
+// enabled
+func getSampleBuffer(metric string) *sampleBuffer {
+	samplesStore.mu.RLock()
+	defer samplesStore.mu.RUnlock()
+
+	return samplesStore.buffers[metric]
+}
+
+// samplesHandler serve /api/v1/metrics/{name}/samples
+func samplesHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/metrics/")
+	if !strings.HasSuffix(path, "/samples") {
+		http.NotFound(w, r)
+		return
+	}
+
+	name := strings.TrimSuffix(path, "/samples")
+	buf := getSampleBuffer(name)
+	if buf == nil {
+		http.Error(w, "metric not found or samples not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Metric  string    `json:"metric"`
+		Samples []*Sample `json:"samples"`
+	}{name, buf.list()})
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<html>
+<head><title>Logmonitor</title></head>
+<body>
+<h1>Logmonitor</h1>
+<p><a href="/metrics">Metrics</a></p>
+{{range .}}
+<h2>{{.Name}}</h2>
+<p><a href="/api/v1/metrics/{{.Name}}/samples">json</a></p>
+<table>
+{{range .Samples}}<tr><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{index .Labels "file"}}</td><td><code>{{.Line}}</code></td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
+
+// statusHandler serve status page with last lines accepted by metrics
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	samplesStore.mu.RLock()
+	names := make([]string, 0, len(samplesStore.buffers))
+	for n := range samplesStore.buffers {
+		names = append(names, n)
+	}
+	samplesStore.mu.RUnlock()
+	sort.Strings(names)
+
+	type metricSamples struct {
+		Name    string
+		Samples []*Sample
+	}
+
+	var data []metricSamples
+	for _, n := range names {
+		if buf := getSampleBuffer(n); buf != nil {
+			data = append(data, metricSamples{n, buf.list()})
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, data); err != nil {
+		log.Errorf("render status page error: %s", err)
+	}
+}
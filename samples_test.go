@@ -0,0 +1,72 @@
+//
+// samples_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSampleBuffer(t *testing.T) {
+	b := newSampleBuffer(3)
+	if len(b.list()) != 0 {
+		t.Errorf("buffer should be empty")
+	}
+
+	for _, l := range []string{"l1", "l2", "l3", "l4"} {
+		b.add(&Sample{Line: l})
+	}
+
+	samples := b.list()
+	if len(samples) != 3 || samples[0].Line != "l4" || samples[2].Line != "l2" {
+		t.Errorf("invalid samples: %v", samples)
+	}
+}
+
+func TestSamplesHandler(t *testing.T) {
+	conf := &Configuration{
+		Workers: []*WorkerConf{
+			&WorkerConf{File: "f1", Metrics: []*Metric{
+				&Metric{Name: "m_samples", Samples: 5},
+				&Metric{Name: "m_nosamples"},
+			}},
+		},
+	}
+	initSamples(conf)
+	defer initSamples(&Configuration{})
+
+	getSampleBuffer("m_samples").add(&Sample{Line: "error <1>"})
+
+	w := httptest.NewRecorder()
+	samplesHandler(w, httptest.NewRequest("GET", "/api/v1/metrics/m_samples/samples", nil))
+	var res struct {
+		Metric  string
+		Samples []*Sample
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatalf("decode response error: %s", err)
+	}
+	if res.Metric != "m_samples" || len(res.Samples) != 1 || res.Samples[0].Line != "error <1>" {
+		t.Errorf("invalid response: %+v", res)
+	}
+
+	w = httptest.NewRecorder()
+	samplesHandler(w, httptest.NewRequest("GET", "/api/v1/metrics/m_nosamples/samples", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("invalid status for metric without samples: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	statusHandler(w, httptest.NewRequest("GET", "/", nil))
+	if !strings.Contains(w.Body.String(), "error &lt;1&gt;") {
+		t.Errorf("missing sample on status page: %s", w.Body.String())
+	}
+}
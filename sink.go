@@ -0,0 +1,98 @@
+//
+// sink.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Sinks receive events observed by metrics (additionally to Prometheus
+// collectors).
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// Sink receive events observed by metrics. Methods may be called
+// concurrently.
+type Sink interface {
+	// Observe record matched by `metric`; `weight` is number of records
+	// represented by event (when sampling)
+	Observe(metric string, labels map[string]string, weight float64)
+	// ObserveValue record matched by `metric` with extracted `value`
+	ObserveValue(metric string, labels map[string]string, value, weight float64)
+	// Close sink
+	Close() error
+}
+
+// SinkDef define interface for sinks types
+type SinkDef interface {
+	Create(conf *OutputConf) (s Sink, err error)
+}
+
+var registeredSinks struct {
+	mu    sync.RWMutex
+	sinks map[string]SinkDef
+}
+
+// MustRegisterSink register sink type `name`; panic when name is already
+// registered
+func MustRegisterSink(name string, s SinkDef) {
+	registeredSinks.mu.Lock()
+	defer registeredSinks.mu.Unlock()
+
+	if registeredSinks.sinks == nil {
+		registeredSinks.sinks = make(map[string]SinkDef)
+	}
+
+	if _, exists := registeredSinks.sinks[name]; exists {
+		panic("sink " + name + " already registered")
+	}
+
+	registeredSinks.sinks[name] = s
+}
+
+func getSinkDef(name string) (SinkDef, bool) {
+	registeredSinks.mu.RLock()
+	defer registeredSinks.mu.RUnlock()
+
+	s, ok := registeredSinks.sinks[name]
+	return s, ok
+}
+
+// registeredSinkTypes return sorted names of registered sinks
+func registeredSinkTypes() []string {
+	registeredSinks.mu.RLock()
+	defer registeredSinks.mu.RUnlock()
+
+	names := make([]string, 0, len(registeredSinks.sinks))
+	for n := range registeredSinks.sinks {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// createSinks create sinks for configured outputs; outputs that can't be
+// created are skipped
+func createSinks(outputs []*OutputConf) (sinks []Sink) {
+	for i, o := range outputs {
+		if o.Disabled {
+			continue
+		}
+
+		sd, ok := getSinkDef(o.Type)
+		if !ok {
+			log.Errorf("Creating output %d error: unknown type '%s'", i+1, o.Type)
+			continue
+		}
+
+		s, err := sd.Create(o)
+		if err != nil {
+			log.Errorf("Creating output %d (%s) error: %s", i+1, o.Type, err)
+			continue
+		}
+
+		sinks = append(sinks, s)
+	}
+	return
+}
@@ -0,0 +1,127 @@
+//
+// statsd.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// StatsD / DogStatsD output.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const defaultStatsdAddress = "127.0.0.1:8125"
+
+// StatsdSink send observed events as StatsD metrics over UDP. Matched
+// records are counters, extracted values - gauges or timers. Labels are
+// sent as DogStatsD tags.
+type StatsdSink struct {
+	conn   net.Conn
+	prefix string
+	// tags enable sending labels as DogStatsD tags
+	tags bool
+	// valueType is StatsD type for values ("g" or "ms")
+	valueType string
+}
+
+func init() {
+	MustRegisterSink("statsd", &StatsdSink{})
+}
+
+// Create new StatsD sink. Options: address (host:port, default
+// 127.0.0.1:8125), prefix, tags (yes/no, default yes), values (gauge or
+// timer, default gauge)
+func (s *StatsdSink) Create(conf *OutputConf) (Sink, error) {
+	address := conf.Options["address"]
+	if address == "" {
+		address = defaultStatsdAddress
+	}
+
+	sink := &StatsdSink{
+		prefix:    conf.Options["prefix"],
+		tags:      conf.Options["tags"] != "no",
+		valueType: "g",
+	}
+
+	switch conf.Options["values"] {
+	case "", "gauge":
+	case "timer":
+		sink.valueType = "ms"
+	default:
+		return nil, errors.Errorf("invalid values type '%s'", conf.Options["values"])
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, errors.Wrap(err, "connect error")
+	}
+	sink.conn = conn
+
+	log.Infof("Sending events to StatsD %s", address)
+
+	return sink, nil
+}
+
+// Observe send counter for matched record; weight is sent as sample rate
+func (s *StatsdSink) Observe(metric string, labels map[string]string, weight float64) {
+	value := "1|c"
+	if weight > 0 && weight != 1 {
+		value += "|@" + strconv.FormatFloat(1/weight, 'g', -1, 64)
+	}
+	s.send(metric, value, labels)
+}
+
+// ObserveValue send counter and value extracted from record
+func (s *StatsdSink) ObserveValue(metric string, labels map[string]string, value, weight float64) {
+	s.Observe(metric, labels, weight)
+	s.send(metric+".value", strconv.FormatFloat(value, 'f', -1, 64)+"|"+s.valueType, labels)
+}
+
+// Close connection
+func (s *StatsdSink) Close() error {
+	return s.conn.Close()
+}
+
+func (s *StatsdSink) send(metric, value string, labels map[string]string) {
+	var b bytes.Buffer
+	b.WriteString(s.prefix)
+	b.WriteString(statsdEscape(metric))
+	b.WriteByte(':')
+	b.WriteString(value)
+
+	if s.tags && len(labels) > 0 {
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b.WriteString("|#")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(statsdEscape(k))
+			b.WriteByte(':')
+			b.WriteString(statsdEscape(labels[k]))
+		}
+	}
+
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		log.Debugf("send to statsd error: %s", err)
+	}
+}
+
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", ",", "_", "#", "_",
+	"@", "_", "\n", "_")
+
+// statsdEscape replace characters reserved in StatsD protocol
+func statsdEscape(s string) string {
+	return statsdReplacer.Replace(s)
+}
@@ -0,0 +1,69 @@
+//
+// statsd_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdSink(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %s", err)
+	}
+	defer pc.Close()
+
+	conf := &OutputConf{
+		Type: "statsd",
+		Options: map[string]string{
+			"address": pc.LocalAddr().String(),
+			"prefix":  "lm.",
+			"values":  "timer",
+		},
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate error: %s", err)
+	}
+
+	sinks := createSinks([]*OutputConf{conf})
+	if len(sinks) != 1 {
+		t.Fatalf("sink not created")
+	}
+	s := sinks[0]
+	defer s.Close()
+
+	labels := map[string]string{"file": "/var/log/a:b", "app": "x"}
+	s.Observe("m1", labels, 1)
+	s.ObserveValue("m2", labels, 1.5, 4)
+
+	expected := []string{
+		"lm.m1:1|c|#app:x,file:/var/log/a_b",
+		"lm.m2:1|c|@0.25|#app:x,file:/var/log/a_b",
+		"lm.m2.value:1.5|ms|#app:x,file:/var/log/a_b",
+	}
+
+	buf := make([]byte, 1024)
+	for _, e := range expected {
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("read error: %s", err)
+		}
+		if string(buf[:n]) != e {
+			t.Errorf("invalid packet: %q, expected %q", buf[:n], e)
+		}
+	}
+}
+
+func TestOutputConfValidate(t *testing.T) {
+	if err := (&OutputConf{Type: "unknown"}).validate(); err == nil {
+		t.Errorf("missing error for unknown output type")
+	}
+}
@@ -0,0 +1,107 @@
+//
+// stdin.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Reader for standard input.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const stdinMaxLineSize = 1024 * 1024
+
+// StdinReader read lines from standard input (file "-" or ":stdin").
+type StdinReader struct {
+	c *WorkerConf
+	r io.Reader
+
+	lines   chan string
+	errors  chan error
+	started bool
+
+	log logger
+}
+
+func init() {
+	MustRegisterReader(&StdinReader{})
+}
+
+// Match reader to configuration file.
+func (s *StdinReader) Match(conf *WorkerConf) (prio int) {
+	if conf.File == "-" || conf.File == ":stdin" {
+		return 99
+	}
+	return -1
+}
+
+// Create new reader for standard input
+func (s *StdinReader) Create(conf *WorkerConf, l logger) (Reader, error) {
+	l.Infof("Monitoring '%s' by Stdin Reader", conf.File)
+	return &StdinReader{
+		c:   conf,
+		r:   os.Stdin,
+		log: l,
+	}, nil
+}
+
+// Start reading standard input
+func (s *StdinReader) Start(ctx context.Context) error {
+	if s.started {
+		return errors.Errorf("already reading")
+	}
+
+	s.started = true
+	s.lines = make(chan string, 100)
+	s.errors = make(chan error, 1)
+
+	go func() {
+		defer close(s.lines)
+
+		scanner := bufio.NewScanner(s.r)
+		scanner.Buffer(make([]byte, 0, 64*1024), stdinMaxLineSize)
+		for scanner.Scan() {
+			select {
+			case s.lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := scanner.Err(); err != nil {
+			s.errors <- err
+		}
+	}()
+
+	return nil
+}
+
+// Stop reading; standard input is not closed
+func (s *StdinReader) Stop() error {
+	return nil
+}
+
+func (s *StdinReader) Read(ctx context.Context) (rec *Record, err error) {
+	select {
+	case l, ok := <-s.lines:
+		if ok {
+			return NewRecord(l, s.c.File), nil
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case err := <-s.errors:
+		return nil, errors.Wrap(err, "read error")
+	default:
+	}
+
+	return nil, io.EOF
+}
@@ -0,0 +1,144 @@
+//
+// textfile.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Writing metrics to file for node_exporter textfile collector.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var textfileLastWrite = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "logmonitor",
+		Name:      "textfile_write_timestamp_seconds",
+		Help:      "Unix time of writing metrics to textfile",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(textfileLastWrite)
+}
+
+// TextfileWriter periodically write metrics to file
+type TextfileWriter struct {
+	conf     *TextfileConf
+	gatherer prometheus.Gatherer
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewTextfileWriter create writer for metrics from `g`
+func NewTextfileWriter(conf *TextfileConf, g prometheus.Gatherer) *TextfileWriter {
+	return &TextfileWriter{
+		conf:     conf,
+		gatherer: g,
+	}
+}
+
+// Start writing metrics in background
+func (t *TextfileWriter) Start() {
+	log.Infof("Writing metrics to %s every %s", t.conf.Path, t.conf.Interval)
+
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+
+	go func() {
+		defer close(t.done)
+
+		ticker := time.NewTicker(t.conf.Interval)
+		defer ticker.Stop()
+
+		t.logError(t.Write())
+
+		for {
+			select {
+			case <-ticker.C:
+				t.logError(t.Write())
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop writing in background and write metrics last time
+func (t *TextfileWriter) Stop() {
+	if t == nil {
+		return
+	}
+
+	if t.stop != nil {
+		close(t.stop)
+		<-t.done
+		t.stop = nil
+	}
+
+	t.logError(t.Write())
+}
+
+func (t *TextfileWriter) logError(err error) {
+	if err != nil {
+		log.Errorf("write metrics to %s error: %s", t.conf.Path, err)
+	}
+}
+
+// Write metrics to temporary file and then rename it to configured path
+func (t *TextfileWriter) Write() error {
+	textfileLastWrite.SetToCurrentTime()
+
+	mfs, err := t.gatherer.Gather()
+	if err != nil {
+		return errors.Wrap(err, "gather metrics error")
+	}
+
+	dir, name := filepath.Split(t.conf.Path)
+	if dir == "" {
+		dir = "."
+	}
+
+	// temporary file must not have .prom extension
+	f, err := ioutil.TempFile(dir, "."+name+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "create temporary file error")
+	}
+	tmpname := f.Name()
+
+	err = writeMetricFamilies(f, mfs)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmpname, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpname, t.conf.Path)
+	}
+
+	if err != nil {
+		os.Remove(tmpname)
+		return errors.Wrap(err, "write file error")
+	}
+
+	return nil
+}
+
+// startTextfileWriter create and start writer when textfile is configured
+func startTextfileWriter(c *Configuration, g prometheus.Gatherer) *TextfileWriter {
+	if c.Textfile == nil {
+		return nil
+	}
+
+	t := NewTextfileWriter(c.Textfile, g)
+	t.Start()
+	return t
+}
@@ -0,0 +1,54 @@
+//
+// textfile_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTextfileWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logmonitor")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	cntr := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "test"})
+	reg.MustRegister(cntr, textfileLastWrite)
+	cntr.Add(3)
+
+	conf := &TextfileConf{Path: filepath.Join(dir, "logmonitor.prom")}
+	if err := conf.validate(); err != nil {
+		t.Fatalf("validate error: %s", err)
+	}
+
+	if err := NewTextfileWriter(conf, reg).Write(); err != nil {
+		t.Fatalf("write error: %s", err)
+	}
+
+	data, err := ioutil.ReadFile(conf.Path)
+	if err != nil {
+		t.Fatalf("read file error: %s", err)
+	}
+	if !strings.Contains(string(data), "test_total 3") ||
+		!strings.Contains(string(data), "logmonitor_textfile_write_timestamp_seconds") {
+		t.Errorf("invalid file content: %s", data)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("temporary files left: %v", files)
+	}
+}
@@ -0,0 +1,306 @@
+//
+// web.go
+// Copyright (C) Karol Będkowski, 2017
+//
+// Web server: TLS, client certificates and basic authentication.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// TLSServerConfig configure TLS for web server
+	TLSServerConfig struct {
+		// CertFile is path to server certificate
+		CertFile string `yaml:"cert_file"`
+		// KeyFile is path to server key
+		KeyFile string `yaml:"key_file"`
+		// ClientAuthType is one of: NoClientCert (default),
+		// RequestClientCert, RequireAnyClientCert, VerifyClientCertIfGiven,
+		// RequireAndVerifyClientCert
+		ClientAuthType string `yaml:"client_auth_type"`
+		// ClientCAFile is path to CA certificates used to verify clients
+		ClientCAFile string `yaml:"client_ca_file"`
+		// MinVersion of TLS: TLS10, TLS11, TLS12 (default), TLS13
+		MinVersion string `yaml:"min_version"`
+
+		XUnknown map[string]interface{} `yaml:",inline"`
+	}
+
+	// WebConfig configure web server
+	WebConfig struct {
+		// TLSServerConfig enable TLS
+		TLSServerConfig *TLSServerConfig `yaml:"tls_server_config"`
+		// BasicAuthUsers map user name to bcrypt hash of password
+		BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+
+		XUnknown map[string]interface{} `yaml:",inline"`
+	}
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                           tls.NoClientCert,
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+var tlsVersions = map[string]uint16{
+	"":      tls.VersionTLS12,
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// LoadWebConfig load and validate web configuration from `filename`
+func LoadWebConfig(filename string) (*WebConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "read web configuration file error")
+	}
+
+	wc := &WebConfig{}
+	if err = yaml.Unmarshal(b, wc); err != nil {
+		return nil, errors.Wrap(err, "web configuration unmarshall error")
+	}
+
+	if err = wc.validate(); err != nil {
+		return nil, errors.Wrap(err, "web configuration validate error")
+	}
+
+	return wc, nil
+}
+
+func (w *WebConfig) validate() error {
+	if msg := checkUnknown(w.XUnknown); msg != "" {
+		log.Warnf("unknown fields in web configuration: %s", msg)
+	}
+
+	for user, hash := range w.BasicAuthUsers {
+		if user == "" {
+			return errors.New("empty user name in basic_auth_users")
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return errors.Wrapf(err, "invalid password hash for user '%s'", user)
+		}
+	}
+
+	t := w.TLSServerConfig
+	if t == nil {
+		return nil
+	}
+
+	if msg := checkUnknown(t.XUnknown); msg != "" {
+		log.Warnf("unknown fields in tls_server_config: %s", msg)
+	}
+
+	if t.CertFile == "" || t.KeyFile == "" {
+		return errors.New("missing cert_file or key_file")
+	}
+
+	authType, ok := clientAuthTypes[t.ClientAuthType]
+	if !ok {
+		return errors.Errorf("invalid client_auth_type '%s'", t.ClientAuthType)
+	}
+
+	if authType == tls.VerifyClientCertIfGiven || authType == tls.RequireAndVerifyClientCert {
+		if t.ClientCAFile == "" {
+			return errors.New("client_ca_file is required for verifying client certificates")
+		}
+	}
+
+	if _, ok := tlsVersions[t.MinVersion]; !ok {
+		return errors.Errorf("invalid min_version '%s'", t.MinVersion)
+	}
+
+	return nil
+}
+
+// tlsConfig create tls configuration; nil when TLS is not enabled
+func (w *WebConfig) tlsConfig() (*tls.Config, error) {
+	t := w.TLSServerConfig
+	if t == nil {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "load certificate error")
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   clientAuthTypes[t.ClientAuthType],
+		MinVersion:   tlsVersions[t.MinVersion],
+	}
+
+	if t.ClientCAFile != "" {
+		ca, err := ioutil.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read client_ca_file error")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificates found in client_ca_file")
+		}
+		cfg.ClientCAs = pool
+	}
+
+	return cfg, nil
+}
+
+// basicAuth check credentials against bcrypt hashes; positive results
+// are cached because bcrypt is slow
+type basicAuth struct {
+	users map[string]string
+	next  http.Handler
+
+	mu    sync.Mutex
+	valid map[[sha256.Size]byte]bool
+}
+
+// dummyHash is used for unknown users so response time don't reveal
+// existing users
+var dummyHash struct {
+	once sync.Once
+	hash []byte
+}
+
+func (b *basicAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	if ok && b.check(user, pass) {
+		b.next.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="logmonitor"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (b *basicAuth) check(user, pass string) bool {
+	hash, known := b.users[user]
+	key := sha256.Sum256([]byte(user + "\x00" + pass + "\x00" + hash))
+
+	b.mu.Lock()
+	cached := b.valid[key]
+	b.mu.Unlock()
+	if cached {
+		return true
+	}
+
+	if !known {
+		dummyHash.once.Do(func() {
+			dummyHash.hash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash.hash, []byte(pass))
+		return false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+
+	b.mu.Lock()
+	b.valid[key] = true
+	b.mu.Unlock()
+
+	return true
+}
+
+// newWebHandler create handler serving metrics, samples api, status page
+// and optionally pprof; when users are configured basic auth is required
+func newWebHandler(wc *WebConfig, metrics http.Handler, enablePprof bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	mux.HandleFunc("/api/v1/metrics/", samplesHandler)
+	mux.HandleFunc("/", statusHandler)
+
+	if enablePprof {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+
+	return withBasicAuth(wc, mux)
+}
+
+// withBasicAuth wrap `next` by basic authentication when users are defined
+// in `wc`
+func withBasicAuth(wc *WebConfig, next http.Handler) http.Handler {
+	if wc == nil || len(wc.BasicAuthUsers) == 0 {
+		return next
+	}
+
+	return &basicAuth{
+		users: wc.BasicAuthUsers,
+		next:  next,
+		valid: make(map[[sha256.Size]byte]bool),
+	}
+}
+
+// newWebServer create server on `address`; TLS is used when configured
+func newWebServer(address string, wc *WebConfig, handler http.Handler) (*http.Server, error) {
+	server := &http.Server{
+		Addr:    address,
+		Handler: handler,
+	}
+
+	if wc != nil {
+		cfg, err := wc.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = cfg
+	}
+
+	return server, nil
+}
+
+// listenAndServe start server created by newWebServer
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// serve accept connections from `ln` by server created by newWebServer
+func serve(server *http.Server, ln net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(ln, "", "")
+	}
+	return server.Serve(ln)
+}
+
+// serveWeb start web server on `address`; TLS is used when configured
+func serveWeb(address string, wc *WebConfig, handler http.Handler) error {
+	server, err := newWebServer(address, wc, handler)
+	if err != nil {
+		return err
+	}
+
+	if server.TLSConfig != nil {
+		log.Infof("Listening on %s (TLS)", address)
+	} else {
+		log.Infof("Listening on %s", address)
+	}
+	return listenAndServe(server)
+}
@@ -0,0 +1,142 @@
+//
+// web_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestWebHandlerBasicAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	wc := &WebConfig{BasicAuthUsers: map[string]string{"user": string(hash)}}
+	if err := wc.validate(); err != nil {
+		t.Fatalf("unexpected validate error: %s", err)
+	}
+
+	metrics := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("metrics"))
+	})
+	h := newWebHandler(wc, metrics, false)
+
+	tests := []struct {
+		user, pass string
+		code       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"user", "bad", http.StatusUnauthorized},
+		{"other", "secret", http.StatusUnauthorized},
+		{"user", "secret", http.StatusOK},
+		// cached
+		{"user", "secret", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if tc.user != "" {
+			req.SetBasicAuth(tc.user, tc.pass)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%s/%s: expected %d, got %d", tc.user, tc.pass, tc.code, rec.Code)
+		}
+	}
+
+	wc.BasicAuthUsers["bad"] = "plain"
+	if err := wc.validate(); err == nil {
+		t.Errorf("missing error for invalid hash")
+	}
+}
+
+func TestWebHandlerPprof(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		h := newWebHandler(nil, http.NotFoundHandler(), enabled)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/", nil))
+		if enabled != (rec.Code == http.StatusOK) {
+			t.Errorf("pprof enabled=%v: unexpected status %d", enabled, rec.Code)
+		}
+	}
+}
+
+func TestWebConfigTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webtls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+
+	confFile := filepath.Join(dir, "web.yml")
+	ioutil.WriteFile(confFile, []byte(`
+tls_server_config:
+  cert_file: `+certFile+`
+  key_file: `+keyFile+`
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: `+certFile+`
+  min_version: TLS13
+`), 0600)
+
+	wc, err := LoadWebConfig(confFile)
+	if err != nil {
+		t.Fatalf("load web config error: %s", err)
+	}
+
+	cfg, err := wc.tlsConfig()
+	if err != nil {
+		t.Fatalf("tls config error: %s", err)
+	}
+	if cfg.ClientAuth != tls.RequireAndVerifyClientCert || cfg.ClientCAs == nil ||
+		cfg.MinVersion != tls.VersionTLS13 || len(cfg.Certificates) != 1 {
+		t.Errorf("invalid tls config: %+v", cfg)
+	}
+
+	wc.TLSServerConfig.ClientCAFile = ""
+	if err := wc.validate(); err == nil {
+		t.Errorf("missing error for missing client_ca_file")
+	}
+	wc.TLSServerConfig.ClientAuthType = "Invalid"
+	if err := wc.validate(); err == nil {
+		t.Errorf("missing error for invalid client_auth_type")
+	}
+}
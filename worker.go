@@ -6,10 +6,14 @@
 package main
 
 import (
+	"context"
 	"github.com/pkg/errors"
+	"io"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 // ReaderDef define interface for readers
@@ -18,6 +22,12 @@ type ReaderDef interface {
 	Create(conf *WorkerConf, l logger) (p Reader, err error)
 }
 
+// ReaderLabelsDef is optional interface for ReaderDef that provide static
+// labels added to all metrics of worker
+type ReaderLabelsDef interface {
+	Labels(conf *WorkerConf) map[string]string
+}
+
 var registeredReaders struct {
 	mu      sync.RWMutex
 	readers []ReaderDef
@@ -55,24 +65,36 @@ func initMetrics(c *Configuration) {
 	} else {
 		metricsCollection = NewMetricCollection()
 	}
+	ResetPatternStats()
+	initSamples(c)
 	metricsCollection.RegisterMetrics(c)
+	metricsCollection.SetSinks(createSinks(c.Outputs))
 }
 
 // Filters configure include/exclude patterns
 type Filters struct {
+	// field to check; empty = message
+	field    string
 	includes []*regexp.Regexp
 	excludes []*regexp.Regexp
+	// includeLits are ids of literals required by includes (set by
+	// buildPrefilter); nil item = pattern must be always checked
+	includeLits [][]int
+
+	// optional statistics for patterns
+	includeStats []*patternStat
+	excludeStats []*patternStat
 }
 
 // BuildFilters build list of patterns according to configuration
 func BuildFilters(patterns []*Filter) (fs []*Filters, err error) {
 	for _, p := range patterns {
-		f := &Filters{}
+		f := &Filters{field: p.Field}
 
 		for _, i := range p.Include {
 			r, err := regexp.Compile(i)
 			if err != nil {
-				return nil, errors.Wrapf(err, "error compile pattern 'include' '%s'")
+				return nil, errors.Wrapf(err, "error compile pattern 'include' '%s'", i)
 			}
 			f.includes = append(f.includes, r)
 		}
@@ -93,13 +115,25 @@ func BuildFilters(patterns []*Filter) (fs []*Filters, err error) {
 	return
 }
 
-func (f *Filters) match(line string) (match bool) {
+// onMessage check if filter is applied to record message
+func (f *Filters) onMessage() bool {
+	return f.field == "" || f.field == "MESSAGE"
+}
+
+// match line against patterns; `found` are literals found in line by
+// prefilter (nil = unknown).
+func (f *Filters) match(line string, found literalSet) (match bool) {
 	if len(f.includes) == 0 {
 		// accept all lines
 		match = true
 	} else {
-		for _, r := range f.includes {
-			if r.MatchString(line) {
+		for i, r := range f.includes {
+			if found != nil && f.includeLits != nil && f.includeLits[i] != nil &&
+				!found.any(f.includeLits[i]) {
+				// required literal not found
+				continue
+			}
+			if matchPattern(r, line, f.includeStats, i) {
 				match = true
 				break
 			}
@@ -107,8 +141,8 @@ func (f *Filters) match(line string) (match bool) {
 	}
 
 	if match {
-		for _, e := range f.excludes {
-			if e.MatchString(line) {
+		for i, e := range f.excludes {
+			if matchPattern(e, line, f.excludeStats, i) {
 				return false
 			}
 		}
@@ -117,19 +151,84 @@ func (f *Filters) match(line string) (match bool) {
 	return
 }
 
-// Reader is generic interface for log readers
+// enableStats create statistics for all patterns; metric can be defined
+// in many workers so statistics are labeled also by `file`
+func (f *Filters) enableStats(file, metric string, filter int) {
+	f.includeStats = make([]*patternStat, len(f.includes))
+	for i := range f.includes {
+		f.includeStats[i] = newPatternStat(file, metric, filter, "include", i)
+	}
+
+	f.excludeStats = make([]*patternStat, len(f.excludes))
+	for i := range f.excludes {
+		f.excludeStats[i] = newPatternStat(file, metric, filter, "exclude", i)
+	}
+}
+
+// matchPattern match line by `r` and update stats when enabled
+func matchPattern(r *regexp.Regexp, line string, stats []*patternStat, idx int) bool {
+	if stats == nil {
+		return r.MatchString(line)
+	}
+	return stats[idx].match(r, line)
+}
+
+// matchRecord check filters against configured field of record.
+// Records without this field are not accepted.
+func (f *Filters) matchRecord(rec *Record, found literalSet) bool {
+	value, ok := rec.Field(f.field)
+	if !ok {
+		return false
+	}
+	if !f.onMessage() {
+		found = nil
+	}
+	return f.match(value, found)
+}
+
+// Reader is generic interface for log readers.
+// Read should return ctx.Err() when context is cancelled. Stop is called
+// after reading goroutine finished.
 type Reader interface {
-	Start() error
-	Read() (line string, err error)
+	Start(ctx context.Context) error
+	Read(ctx context.Context) (rec *Record, err error)
 	Stop() error
 }
 
+// fieldLabel define label which value is taken from record field
+type fieldLabel struct {
+	// position in label values
+	pos   int
+	field string
+}
+
 type metricFilters struct {
 	name    string
 	filters []*Filters
 	labels  []string
 
+	fieldLabels []fieldLabel
+
 	extractPattern *regexp.Regexp
+	// valueField is field used to extract value; empty = message
+	valueField string
+
+	// sampler limit records evaluated by metric; may be nil
+	sampler *sampler
+	// limitMatched apply sampler only to matched records
+	limitMatched bool
+
+	// notifier send matched records to webhook; may be nil
+	notifier *Notifier
+	// labelNames are names of labels (for notifications, forwarding and
+	// samples)
+	labelNames []string
+	// samples keep last accepted lines; may be nil
+	samples *sampleBuffer
+
+	forwardConf *ForwardConf
+	// forward write accepted lines; opened when worker start
+	forward *Forwarder
 }
 
 func (m metricFilters) String() string {
@@ -137,12 +236,22 @@ func (m metricFilters) String() string {
 }
 
 func (m *metricFilters) AcceptLine(line string) (accepted bool) {
+	return m.AcceptRecord(NewRecord(line, ""))
+}
+
+// AcceptRecord check is record match any of filters
+func (m *metricFilters) AcceptRecord(rec *Record) (accepted bool) {
+	return m.acceptRecord(rec, nil)
+}
+
+// acceptRecord check record using literals found by prefilter
+func (m *metricFilters) acceptRecord(rec *Record, found literalSet) (accepted bool) {
 	if len(m.filters) == 0 {
 		return true
 	}
 
 	for _, p := range m.filters {
-		if p.match(line) {
+		if p.matchRecord(rec, found) {
 			return true
 		}
 	}
@@ -150,16 +259,85 @@ func (m *metricFilters) AcceptLine(line string) (accepted bool) {
 	return false
 }
 
+// labelValues return values of labels for record
+func (m *metricFilters) labelValues(rec *Record) []string {
+	if len(m.fieldLabels) == 0 {
+		return m.labels
+	}
+
+	values := make([]string, len(m.labels))
+	copy(values, m.labels)
+	for _, fl := range m.fieldLabels {
+		values[fl.pos], _ = rec.Field(fl.field)
+	}
+
+	return values
+}
+
+// notify send record to webhook
+func (m *metricFilters) notify(rec *Record, labels []string) {
+	m.notifier.Notify(&NotifyEvent{
+		Metric:    m.name,
+		Labels:    labelsMap(m.labelNames, labels),
+		Line:      rec.Message,
+		Timestamp: recordTime(rec),
+	})
+}
+
+// addSample keep record in samples
+func (m *metricFilters) addSample(rec *Record, labels []string) {
+	m.samples.add(&Sample{
+		Time:   recordTime(rec),
+		Line:   rec.Message,
+		Labels: labelsMap(m.labelNames, labels),
+	})
+}
+
+// recordTime return time of record or current time when unknown
+func recordTime(rec *Record) time.Time {
+	if rec.Time.IsZero() {
+		return time.Now()
+	}
+	return rec.Time
+}
+
+// extractValue find value in record; return false when value not found
+func (m *metricFilters) extractValue(rec *Record) (val float64, ok bool, err error) {
+	value, ok := rec.Field(m.valueField)
+	if !ok {
+		return 0, false, nil
+	}
+
+	if m.extractPattern != nil {
+		match := m.extractPattern.FindStringSubmatch(value)
+		if len(match) < 2 {
+			return 0, false, nil
+		}
+		value = match[1]
+	}
+
+	val, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return val, err == nil, errors.Wrapf(err, "convert '%v' to float failed", value)
+}
+
 // Worker watch one file and report matched lines
 type Worker struct {
 	c *WorkerConf
 
 	metrics []*metricFilters
+	// prefilter find literals required by patterns; may be nil
+	prefilter *prefilter
+	// forward write lines accepted by any metric; opened when worker start
+	forward *Forwarder
 
 	log    logger
 	reader Reader
 
-	stopping bool
+	cancel context.CancelFunc
+	// done is closed when reading finish
+	done chan struct{}
+	// stopped is closed when Stop finish (reader stopped, position saved)
+	stopped chan struct{}
 }
 
 // NewWorker create new background worker according to configuration
@@ -167,8 +345,10 @@ type Worker struct {
 // by one worker.
 func NewWorker(conf *WorkerConf) (worker *Worker, err error) {
 	w := &Worker{
-		c:   conf,
-		log: log.With("file", conf.File),
+		c:       conf,
+		log:     log.With("file", conf.File),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 
 	rd := getReaderForConf(conf)
@@ -192,9 +372,33 @@ func NewWorker(conf *WorkerConf) (worker *Worker, err error) {
 		}
 
 		mf := &metricFilters{
-			name:    metric.Name,
-			filters: ftrs,
-			labels:  metric.StaticLabels,
+			name:       metric.Name,
+			filters:    ftrs,
+			labels:     metric.StaticLabels,
+			valueField: metric.ValueField,
+			sampler:    newSampler(metric.SampleRate, metric.MaxPerSecond),
+
+			limitMatched: metric.LimitMatched,
+		}
+
+		// first label is always file
+		for i, l := range metric.labelNames() {
+			if field, ok := metric.FieldLabels[l]; ok {
+				mf.fieldLabels = append(mf.fieldLabels, fieldLabel{i + 1, field})
+			}
+		}
+
+		if metric.Notify != nil {
+			mf.notifier = NewNotifier(metric.Name, metric.Notify)
+		}
+
+		if metric.Samples > 0 {
+			mf.samples = getSampleBuffer(metric.Name)
+		}
+
+		if metric.Notify != nil || metric.Forward != nil || mf.samples != nil {
+			mf.forwardConf = metric.Forward
+			mf.labelNames = append([]string{"file"}, metric.labelNames()...)
 		}
 
 		if metric.ValuePattern != "" {
@@ -206,53 +410,170 @@ func NewWorker(conf *WorkerConf) (worker *Worker, err error) {
 			mf.extractPattern = p
 			// if not defined filters; use variable pattern re for filtering
 			if len(mf.filters) == 0 {
-				mf.filters = []*Filters{&Filters{includes: []*regexp.Regexp{p}}}
+				mf.filters = []*Filters{&Filters{
+					field:    metric.ValueField,
+					includes: []*regexp.Regexp{p},
+				}}
 			}
 		}
+
+		if *patternStats {
+			for i, f := range mf.filters {
+				f.enableStats(conf.File, mf.name, i)
+			}
+		}
+
 		w.metrics = append(w.metrics, mf)
 	}
 
+	w.prefilter = buildPrefilter(w.metrics)
+
 	return w, nil
 }
 
-// Start worker (reading file)
-func (w *Worker) Start() error {
+// Start worker (reading file); worker is stopped when `ctx` is cancelled
+// or Stop is called.
+func (w *Worker) Start(ctx context.Context) error {
 	if w.reader != nil {
 		w.log.Debug("start monitoring")
 
-		if err := w.reader.Start(); err != nil {
+		ctx, w.cancel = context.WithCancel(ctx)
+
+		if err := w.openForwarders(); err != nil {
+			close(w.done)
+			return err
+		}
+
+		if err := w.reader.Start(ctx); err != nil {
+			w.closeForwarders()
+			close(w.done)
 			return err
 		}
 
-		go w.read()
+		for _, mf := range w.metrics {
+			if mf.notifier != nil {
+				mf.notifier.Start()
+			}
+		}
+
+		go w.read(ctx)
 
 		w.log.Info("worker started")
 	}
 	return nil
 }
 
+// openForwarders open forward targets of worker and metrics
+func (w *Worker) openForwarders() (err error) {
+	if w.c.Forward != nil {
+		if w.forward, err = openForwarder(w.c.Forward); err != nil {
+			return errors.Wrapf(err, "open forward target %s error", w.c.Forward.Target)
+		}
+	}
+
+	for _, mf := range w.metrics {
+		if mf.forwardConf == nil {
+			continue
+		}
+		if mf.forward, err = openForwarder(mf.forwardConf); err != nil {
+			w.closeForwarders()
+			return errors.Wrapf(err, "open forward target %s error", mf.forwardConf.Target)
+		}
+	}
+
+	return nil
+}
+
+// closeForwarders release all opened forward targets
+func (w *Worker) closeForwarders() {
+	if w.forward != nil {
+		releaseForwarder(w.forward)
+		w.forward = nil
+	}
+
+	for _, mf := range w.metrics {
+		if mf.forward != nil {
+			releaseForwarder(mf.forward)
+			mf.forward = nil
+		}
+	}
+}
+
+// Done returns channel closed when worker finish reading (i.e. on end of
+// input)
+func (w *Worker) Done() <-chan struct{} {
+	return w.done
+}
+
 // Filename returns file monitored by worker
 func (w *Worker) Filename() string {
 	return w.c.File
 }
 
-// Stop worker
+// Stopped returns channel closed when Stop finish
+func (w *Worker) Stopped() <-chan struct{} {
+	return w.stopped
+}
+
+// Stop worker; wait for reading goroutine finish and then stop reader.
+// Must be called only once.
 func (w *Worker) Stop() {
-	w.stopping = true
-	if w.reader != nil {
-		w.log.Debug("stop monitoring")
-		w.reader.Stop()
+	defer close(w.stopped)
+
+	if w.cancel == nil {
+		// not started
+		return
+	}
+
+	w.log.Debug("stop monitoring")
+	w.cancel()
+	<-w.done
+	if err := w.reader.Stop(); err != nil {
+		w.log.Errorf("stop reader error: %s", err)
+	}
+	for _, mf := range w.metrics {
+		if mf.notifier != nil {
+			mf.notifier.Stop()
+		}
 	}
+	w.closeForwarders()
+	w.log.Debug("worker stopped")
 }
 
-func (w *Worker) read() {
-	var line string
+func (w *Worker) read(ctx context.Context) {
+	var rec *Record
 	var err error
 
+	// optional queue for parallel matching
+	var queue chan *Record
+	var wg sync.WaitGroup
+
+	if n := w.c.Pipeline.parallel(); n > 0 {
+		queue = make(chan *Record, w.c.Pipeline.queueSize())
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go w.processQueue(queue, &wg)
+		}
+	}
+
+	defer func() {
+		if queue != nil {
+			// process remaining records
+			close(queue)
+			wg.Wait()
+		}
+		close(w.done)
+	}()
+
 	for {
-		line, err = w.reader.Read()
+		rec, err = w.reader.Read(ctx)
+
+		if ctx.Err() != nil {
+			return
+		}
 
-		if w.stopping {
+		if err == io.EOF {
+			w.log.Info("end of input")
 			return
 		}
 
@@ -262,30 +583,117 @@ func (w *Worker) read() {
 			continue
 		}
 
-		if line == "" {
+		if rec == nil || rec.Message == "" {
 			continue
 		}
 
 		ObserveReadSuccess(w.c.File)
+		ObserveBytesRead(w.c.File, len(rec.Message))
 
-		for _, mf := range w.metrics {
-			if !mf.AcceptLine(line) {
+		if queue == nil {
+			w.process(rec)
+			continue
+		}
+
+		if w.c.Pipeline.DropWhenFull {
+			select {
+			case queue <- rec:
+			default:
+				ObserveRecordDropped(w.c.File)
+			}
+		} else {
+			queue <- rec
+		}
+		ObserveQueueLength(w.c.File, len(queue))
+	}
+}
+
+// processQueue match records from queue until queue is closed
+func (w *Worker) processQueue(queue <-chan *Record, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for rec := range queue {
+		w.process(rec)
+		ObserveQueueLength(w.c.File, len(queue))
+	}
+}
+
+// process match record against all metrics and update metrics
+// allow check sampling and rate limit for record; skipped records are
+// counted.
+func (mf *metricFilters) allow(now time.Time) (weight float64, ok bool) {
+	weight, skipReason := mf.sampler.allow(now)
+	if skipReason != "" {
+		ObserveRecordSkipped(mf.name, skipReason, weight)
+		return weight, false
+	}
+	return weight, true
+}
+
+func (w *Worker) process(rec *Record) {
+	found := w.prefilter.scan(rec.Message)
+	now := time.Now()
+	accepted := false
+
+	for _, mf := range w.metrics {
+		weight := 1.0
+		ok := true
+
+		// by default skip evaluating patterns for records above limits
+		if !mf.limitMatched {
+			if weight, ok = mf.allow(now); !ok {
+				continue
+			}
+		}
+
+		if !mf.acceptRecord(rec, found) {
+			continue
+		}
+
+		if mf.limitMatched {
+			if weight, ok = mf.allow(now); !ok {
 				continue
 			}
+		}
+
+		accepted = true
+		labels := mf.labelValues(rec)
+
+		if mf.notifier != nil {
+			mf.notify(rec, labels)
+		}
+
+		if mf.samples != nil {
+			mf.addSample(rec, labels)
+		}
 
-			if mf.extractPattern == nil {
-				metricsCollection.Observe(mf.name, mf.labels)
+		if mf.forward != nil {
+			if mf.forwardConf.Labels {
+				mf.forward.Forward(rec.Message, mf.name, mf.labelNames, labels)
 			} else {
-				// extract value from line, convert to float64 and expose
-				m := mf.extractPattern.FindStringSubmatch(line)
-				if len(m) > 1 {
-					if val, err := strconv.ParseFloat(m[1], 64); err == nil {
-						metricsCollection.ObserveWV(mf.name, mf.labels, val)
-					} else {
-						w.log.Info("convert '%v' in line '%v' to float failed: %s", m[1], line, err)
-					}
-				}
+				mf.forward.Forward(rec.Message, "", nil, nil)
 			}
 		}
+
+		if mf.extractPattern == nil && mf.valueField == "" {
+			metricsCollection.Observe(mf.name, labels, weight)
+			continue
+		}
+
+		// extract value from record, convert to float64 and expose
+		val, ok, err := mf.extractValue(rec)
+		if err != nil {
+			w.log.Infof("extract value from '%v' failed: %s", rec.Message, err)
+		} else if ok {
+			metricsCollection.ObserveWV(mf.name, labels, val, weight)
+		}
+	}
+
+	if accepted && w.forward != nil {
+		if w.c.Forward.Labels {
+			w.forward.Forward(rec.Message, "", []string{"file"}, []string{w.c.File})
+		} else {
+			w.forward.Forward(rec.Message, "", nil, nil)
+		}
 	}
 }
@@ -0,0 +1,346 @@
+//
+// worker_test.go
+// Copyright (C) 2017 Karol Będkowski <Karol Będkowski@kntbk>
+//
+// Distributed under terms of the MIT license.
+//
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricFiltersRecord(t *testing.T) {
+	metric := &Metric{
+		Name: "m1",
+		Patterns: []*Filter{
+			&Filter{Include: []string{"^sudo$"}, Field: "SYSLOG_IDENTIFIER"},
+		},
+		Labels:      map[string]string{"app": "a1"},
+		FieldLabels: map[string]string{"host": "_HOSTNAME"},
+		ValueField:  "DURATION",
+	}
+	conf := &Configuration{
+		Workers: []*WorkerConf{
+			&WorkerConf{File: "f1", Metrics: []*Metric{metric}},
+		},
+	}
+	conf.prepareLabels()
+
+	w, err := NewWorker(conf.Workers[0])
+	if err != nil {
+		t.Fatalf("create worker error: %s", err)
+	}
+	mf := w.metrics[0]
+
+	rec := &Record{
+		Message: "session opened",
+		Fields: map[string]string{
+			"SYSLOG_IDENTIFIER": "sudo",
+			"_HOSTNAME":         "host1",
+			"DURATION":          "1.5",
+		},
+	}
+
+	if !mf.AcceptRecord(rec) {
+		t.Errorf("record should be accepted")
+	}
+	if mf.AcceptLine("sudo") {
+		t.Errorf("line without field should not be accepted")
+	}
+
+	labels := mf.labelValues(rec)
+	if len(labels) != 3 || labels[0] != "f1" || labels[1] != "a1" || labels[2] != "host1" {
+		t.Errorf("invalid labels: %v", labels)
+	}
+	// static labels must not be modified
+	if metric.StaticLabels[2] != "" {
+		t.Errorf("static labels modified: %v", metric.StaticLabels)
+	}
+
+	val, ok, err := mf.extractValue(rec)
+	if err != nil || !ok || val != 1.5 {
+		t.Errorf("invalid value extracted: %v, %v, %v", val, ok, err)
+	}
+}
+
+func TestFiltersPatternStats(t *testing.T) {
+	fs, err := BuildFilters([]*Filter{
+		&Filter{Include: []string{"error", "fail"}, Exclude: []string{"debug"}},
+	})
+	if err != nil {
+		t.Fatalf("build filters error: %s", err)
+	}
+	defer ResetPatternStats()
+
+	f := fs[0]
+	f.enableStats("f1", "m_stats", 0)
+	for _, line := range []string{"error 1", "fail 2", "debug error", "ok"} {
+		f.match(line, nil)
+	}
+
+	if v := testutil.ToFloat64(patternMatchesCntr.WithLabelValues("f1", "m_stats", "0", "include", "0")); v != 2 {
+		t.Errorf("invalid number of include matches: %v", v)
+	}
+	if v := testutil.ToFloat64(patternMatchesCntr.WithLabelValues("f1", "m_stats", "0", "exclude", "0")); v != 1 {
+		t.Errorf("invalid number of exclude matches: %v", v)
+	}
+}
+
+// blockingReader is reader which Stop wait for `release`
+type blockingReader struct {
+	release chan struct{}
+}
+
+func (b *blockingReader) Start(ctx context.Context) error { return nil }
+
+func (b *blockingReader) Read(ctx context.Context) (*Record, error) {
+	<-ctx.Done()
+	return nil, io.EOF
+}
+
+func (b *blockingReader) Stop() error {
+	<-b.release
+	return nil
+}
+
+func TestStopWorkersTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := &Worker{
+		c:       &WorkerConf{File: "slow"},
+		log:     log,
+		reader:  &blockingReader{release},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	fast := &Worker{
+		c:       &WorkerConf{File: "fast"},
+		log:     log,
+		reader:  &blockingReader{make(chan struct{})},
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	close(fast.reader.(*blockingReader).release)
+
+	for _, w := range []*Worker{slow, fast} {
+		if err := w.Start(context.Background()); err != nil {
+			t.Fatalf("start worker error: %s", err)
+		}
+	}
+
+	pending := stopWorkers([]*Worker{slow, fast}, 100*time.Millisecond)
+	if len(pending) != 1 || pending[0] != slow {
+		t.Fatalf("expected only slow worker pending, got %v", pending)
+	}
+
+	close(release)
+
+	done := make(chan struct{})
+	go func() {
+		waitWorkers(pending, 10*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitWorkers not finished after worker stop")
+	}
+}
+
+// legacyReader is LineReader which Read block until Stop
+type legacyReader struct {
+	stop chan struct{}
+}
+
+func (l *legacyReader) Start() error { return nil }
+
+func (l *legacyReader) Read() (string, error) {
+	<-l.stop
+	return "", io.EOF
+}
+
+func (l *legacyReader) Stop() error {
+	close(l.stop)
+	return nil
+}
+
+func TestStopWorkerLineReader(t *testing.T) {
+	w := &Worker{
+		c:       &WorkerConf{File: "legacy"},
+		log:     log,
+		reader:  WrapLineReader(&legacyReader{make(chan struct{})}, "legacy"),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatalf("start worker error: %s", err)
+	}
+
+	go w.Stop()
+
+	select {
+	case <-w.Stopped():
+	case <-time.After(time.Second):
+		t.Fatal("worker with line reader not stopped")
+	}
+}
+
+// sliceReader return records from list and then io.EOF
+type sliceReader struct {
+	lines []string
+	pos   int
+}
+
+func (s *sliceReader) Start(ctx context.Context) error { return nil }
+
+func (s *sliceReader) Read(ctx context.Context) (*Record, error) {
+	if s.pos >= len(s.lines) {
+		return nil, io.EOF
+	}
+	s.pos++
+	return NewRecord(s.lines[s.pos-1], "pipeline_test"), nil
+}
+
+func (s *sliceReader) Stop() error { return nil }
+
+func TestWorkerPipelineCounters(t *testing.T) {
+	const records = 2000
+
+	conf := &Configuration{
+		Workers: []*WorkerConf{
+			&WorkerConf{
+				File:     "pipeline_test",
+				Pipeline: &PipelineConf{Workers: 4, QueueSize: 10},
+				Metrics: []*Metric{
+					&Metric{
+						Name:     "pipeline_test_all",
+						Patterns: []*Filter{&Filter{Include: []string{"^rec"}}},
+					},
+					&Metric{
+						Name:     "pipeline_test_odd",
+						Patterns: []*Filter{&Filter{Include: []string{"odd$"}}},
+					},
+					&Metric{
+						Name:         "pipeline_test_value",
+						ValuePattern: `^rec (\d+)`,
+					},
+				},
+			},
+		},
+	}
+	conf.prepareLabels()
+	initMetrics(conf)
+
+	w, err := NewWorker(conf.Workers[0])
+	if err != nil {
+		t.Fatalf("create worker error: %s", err)
+	}
+
+	var lines []string
+	for i := 0; i < records; i++ {
+		if i%2 == 1 {
+			lines = append(lines, fmt.Sprintf("rec %d odd", i))
+		} else {
+			lines = append(lines, fmt.Sprintf("rec %d even", i))
+		}
+	}
+	w.reader = &sliceReader{lines: lines}
+
+	// counter is global; check only increase
+	processed := testutil.ToFloat64(lineProcessedCntr.WithLabelValues("pipeline_test"))
+
+	if err := w.Start(context.Background()); err != nil {
+		t.Fatalf("start worker error: %s", err)
+	}
+
+	select {
+	case <-w.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("worker not finished")
+	}
+	w.Stop()
+
+	if v := testutil.ToFloat64(lineProcessedCntr.WithLabelValues("pipeline_test")) - processed; v != records {
+		t.Errorf("expected %d records processed, got %v", records, v)
+	}
+
+	exp := map[string]float64{
+		"pipeline_test_all":   records,
+		"pipeline_test_odd":   records / 2,
+		"pipeline_test_value": records,
+	}
+	for name, e := range exp {
+		mg := metricsCollection.metrics[name]
+		if v := testutil.ToFloat64(mg.lineMatchedCntr.WithLabelValues("pipeline_test")); v != e {
+			t.Errorf("%s: expected %v, got %v", name, e, v)
+		}
+	}
+}
+
+func TestWorkerRateLimit(t *testing.T) {
+	conf := &Configuration{
+		Workers: []*WorkerConf{
+			&WorkerConf{
+				File: "ratelimit_test",
+				Metrics: []*Metric{
+					&Metric{
+						Name:         "ratelimit_test_all",
+						Patterns:     []*Filter{&Filter{Include: []string{"^error"}}},
+						MaxPerSecond: 5,
+					},
+					&Metric{
+						Name:         "ratelimit_test_matched",
+						Patterns:     []*Filter{&Filter{Include: []string{"^error"}}},
+						MaxPerSecond: 5,
+						LimitMatched: true,
+					},
+				},
+			},
+		},
+	}
+	conf.prepareLabels()
+	initMetrics(conf)
+
+	w, err := NewWorker(conf.Workers[0])
+	if err != nil {
+		t.Fatalf("create worker error: %s", err)
+	}
+
+	skippedAll := recordsSkippedCntr.WithLabelValues("ratelimit_test_all", skipReasonRateLimit)
+	skippedAllStart := testutil.ToFloat64(skippedAll)
+	skippedMatched := recordsSkippedCntr.WithLabelValues("ratelimit_test_matched", skipReasonRateLimit)
+	skippedMatchedStart := testutil.ToFloat64(skippedMatched)
+
+	for i := 0; i < 20; i++ {
+		w.process(NewRecord("info", "ratelimit_test"))
+	}
+	for i := 0; i < 8; i++ {
+		w.process(NewRecord("error", "ratelimit_test"))
+	}
+
+	// limit exhausted by first records; errors are not evaluated
+	mg := metricsCollection.metrics["ratelimit_test_all"]
+	if v := testutil.ToFloat64(mg.lineMatchedCntr.WithLabelValues("ratelimit_test")); v != 0 {
+		t.Errorf("invalid number of counted records: %v", v)
+	}
+	if v := testutil.ToFloat64(skippedAll) - skippedAllStart; v != 23 {
+		t.Errorf("invalid number of skipped records: %v", v)
+	}
+
+	// not matched records don't use limit
+	mg = metricsCollection.metrics["ratelimit_test_matched"]
+	if v := testutil.ToFloat64(mg.lineMatchedCntr.WithLabelValues("ratelimit_test")); v != 5 {
+		t.Errorf("invalid number of counted matched records: %v", v)
+	}
+	if v := testutil.ToFloat64(skippedMatched) - skippedMatchedStart; v != 3 {
+		t.Errorf("invalid number of skipped matched records: %v", v)
+	}
+}